@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -10,83 +12,665 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
 // 常量定义
 const (
-	ValidationType = "validation"
-	MessageType    = "msg"
-	HeartbeatType  = "heartbeat"
+	ValidationType  = "validation"
+	MessageType     = "msg"
+	HeartbeatType   = "heartbeat"
+	VideoType       = "vid"
+	SubscribeType   = "subscribe"
+	UnsubscribeType = "unsubscribe"
 )
 
+// 机器人数据话题
+const (
+	LowStateTopic       = "rt/lf/lowstate"
+	SportModeStateTopic = "rt/lf/sportmodestate"
+	SportRequestTopic   = "rt/api/sport/request" // 运动命令默认发布的话题
+)
+
+// 握手加密模式
+const (
+	HandshakeCipherECB = "ecb" // 旧固件使用的模式
+	HandshakeCipherCBC = "cbc" // 随机IV置于密文前
+)
+
+// 连接失败的类别，可用errors.Is区分，底层原因同样可用errors.Is/As取得
+var (
+	ErrOfferFailed      = errors.New("创建提议失败")
+	ErrHandshakeFailed  = errors.New("与机器人握手失败")
+	ErrSDPFailed        = errors.New("应用机器人应答SDP失败")
+	ErrValidationFailed = errors.New("验证失败")
+	ErrCommandNotAcked  = errors.New("命令未被确认")
+)
+
+// 摇杆循环已被停止或替换，尚未发出的Move不再发送
+var errJoystickStopped = errors.New("摇杆已停止")
+
+// 默认心跳间隔
+const defaultHeartbeatInterval = 2 * time.Second
+
+// 默认连接超时时间
+const defaultConnectionTimeout = 10 * time.Second
+
+// Move命令的安全速度范围: x前后(m/s)、y左右(m/s)、z转向(rad/s)
+const (
+	moveMinX, moveMaxX = -2.5, 3.8
+	moveMinY, moveMaxY = -1.0, 1.0
+	moveMinZ, moveMaxZ = -4.0, 4.0
+)
+
+// 摇杆模式下Move的发送间隔和默认死人开关时间
+const (
+	joystickSendInterval   = 100 * time.Millisecond
+	defaultJoystickDeadman = 500 * time.Millisecond
+)
+
+// 数据通道发送缓冲的上限、低水位和缓冲满时的最长等待时间，上限低于低水位时以上限作为低水位
+const (
+	defaultMaxBufferedAmount   = 1024 * 1024
+	bufferedAmountLowThreshold = 256 * 1024
+	backpressureWait           = 200 * time.Millisecond
+)
+
+// 消息回调默认的工作协程数和队列长度，单个工作协程可保持回调顺序
+const (
+	defaultCallbackWorkers   = 1
+	defaultCallbackQueueSize = 256
+)
+
+// 默认接收消息大小上限，超过时不解析直接丢弃
+// pion的数据通道读缓冲为65535字节，更大的消息会使读取失败并关闭数据通道，不会到达上限检查
+const defaultMaxMessageSize = math.MaxUint16
+
+// 验证重试的默认次数和初始退避时间，每次重试退避时间翻倍
+const (
+	defaultMaxValidationAttempts = 5
+	defaultValidationBackoff     = 500 * time.Millisecond
+)
+
+// SendCommandAck未收到确认时的默认重发次数
+const defaultCommandAckRetries = 2
+
+// 连接事件记录的最大条数
+const maxConnectionEvents = 100
+
+// 命令历史记录的最大条数，摇杆循环每秒约产生10条
+const maxCommandHistory = 1000
+
+// 机器人信令HTTP接口的默认端口和请求超时
+const (
+	defaultRobotSignalingPort = 9991
+	defaultRobotHTTPTimeout   = 10 * time.Second
+)
+
+// LogLevel 日志级别
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// ParseLogLevel 解析日志级别字符串(debug/info/warn/error)
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "", "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("未知日志级别: %s", level)
+	}
+}
+
+// Logger 分级日志接口
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger 基于标准库log的默认日志实现，低于level的日志被丢弃
+type stdLogger struct {
+	level LogLevel
+}
+
+// NewStdLogger 创建输出到标准库log的分级日志
+func NewStdLogger(level LogLevel) Logger {
+	return &stdLogger{level: level}
+}
+
+func (l *stdLogger) logf(level LogLevel, prefix, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	log.Printf(prefix+format, args...)
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, "[DEBUG] ", format, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, "[INFO] ", format, args...)
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, "[WARN] ", format, args...)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, "[ERROR] ", format, args...)
+}
+
+// 加解密等辅助函数使用的日志
+var defaultLogger = NewStdLogger(LogLevelInfo)
+
+// SportCommandInfo 运动命令元数据
+type SportCommandInfo struct {
+	Name        string   `json:"name"`
+	ID          int      `json:"id"`
+	Params      []string `json:"params,omitempty"` // 必填参数字段，为空表示无需参数
+	Description string   `json:"description"`
+}
+
+// 运动命令表
+var SportCommands = []SportCommandInfo{
+	{Name: "Damp", ID: 1001, Description: "阻尼模式，电机卸力"},
+	{Name: "BalanceStand", ID: 1002, Description: "平衡站立"},
+	{Name: "StopMove", ID: 1003, Description: "停止移动"},
+	{Name: "StandUp", ID: 1004, Description: "站起"},
+	{Name: "StandDown", ID: 1005, Description: "趴下"},
+	{Name: "RecoveryStand", ID: 1006, Description: "恢复站立"},
+	{Name: "Euler", ID: 1007, Params: []string{"x", "y", "z"}, Description: "设置机身姿态角(roll/pitch/yaw)"},
+	{Name: "Move", ID: 1008, Params: []string{"x", "y", "z"}, Description: "按速度移动(前后/左右/转向)"},
+	{Name: "Sit", ID: 1009, Description: "坐下"},
+	{Name: "RiseSit", ID: 1010, Description: "从坐姿站起"},
+	{Name: "SwitchGait", ID: 1011, Params: []string{"data"}, Description: "切换步态"},
+	{Name: "Trigger", ID: 1012, Description: "触发"},
+	{Name: "BodyHeight", ID: 1013, Params: []string{"data"}, Description: "设置机身高度"},
+	{Name: "FootRaiseHeight", ID: 1014, Params: []string{"data"}, Description: "设置抬腿高度"},
+	{Name: "SpeedLevel", ID: 1015, Params: []string{"data"}, Description: "设置速度档位"},
+	{Name: "Hello", ID: 1016, Description: "打招呼"},
+	{Name: "Stretch", ID: 1017, Description: "伸懒腰"},
+	{Name: "TrajectoryFollow", ID: 1018, Description: "轨迹跟随"},
+	{Name: "ContinuousGait", ID: 1019, Description: "连续步态"},
+	{Name: "Content", ID: 1020, Description: "开心"},
+	{Name: "Wallow", ID: 1021, Description: "打滚"},
+	{Name: "Dance1", ID: 1022, Description: "舞蹈1"},
+	{Name: "Dance2", ID: 1023, Description: "舞蹈2"},
+	{Name: "GetBodyHeight", ID: 1024, Description: "查询机身高度"},
+	{Name: "GetFootRaiseHeight", ID: 1025, Description: "查询抬腿高度"},
+	{Name: "GetSpeedLevel", ID: 1026, Description: "查询速度档位"},
+	{Name: "SwitchJoystick", ID: 1027, Description: "切换遥控器控制"},
+	{Name: "Pose", ID: 1028, Description: "摆姿势"},
+	{Name: "Scrape", ID: 1029, Description: "拜年作揖"},
+	{Name: "FrontFlip", ID: 1030, Description: "前空翻"},
+	{Name: "FrontJump", ID: 1031, Description: "向前跳"},
+	{Name: "FrontPounce", ID: 1032, Description: "向前扑"},
+	{Name: "WiggleHips", ID: 1033, Description: "扭屁股"},
+	{Name: "GetState", ID: 1034, Description: "查询状态"},
+	{Name: "EconomicGait", ID: 1035, Description: "节能步态"},
+	{Name: "FingerHeart", ID: 1036, Description: "比心"},
+}
+
 // 机器人命令映射
-var SportCmd = map[string]int{
-	"Damp":               1001,
-	"BalanceStand":       1002,
-	"StopMove":           1003,
-	"StandUp":            1004,
-	"StandDown":          1005,
-	"RecoveryStand":      1006,
-	"Euler":              1007,
-	"Move":               1008,
-	"Sit":                1009,
-	"RiseSit":            1010,
-	"SwitchGait":         1011,
-	"Trigger":            1012,
-	"BodyHeight":         1013,
-	"FootRaiseHeight":    1014,
-	"SpeedLevel":         1015,
-	"Hello":              1016,
-	"Stretch":            1017,
-	"TrajectoryFollow":   1018,
-	"ContinuousGait":     1019,
-	"Content":            1020,
-	"Wallow":             1021,
-	"Dance1":             1022,
-	"Dance2":             1023,
-	"GetBodyHeight":      1024,
-	"GetFootRaiseHeight": 1025,
-	"GetSpeedLevel":      1026,
-	"SwitchJoystick":     1027,
-	"Pose":               1028,
-	"Scrape":             1029,
-	"FrontFlip":          1030,
-	"FrontJump":          1031,
-	"FrontPounce":        1032,
-	"WiggleHips":         1033,
-	"GetState":           1034,
-	"EconomicGait":       1035,
-	"FingerHeart":        1036,
+var SportCmd = func() map[string]int {
+	cmds := make(map[string]int, len(SportCommands))
+	for _, info := range SportCommands {
+		cmds[info.Name] = info.ID
+	}
+	return cmds
+}()
+
+// 需要参数的命令及其必填字段
+var sportCmdParams = func() map[string][]string {
+	params := make(map[string][]string)
+	for _, info := range SportCommands {
+		if len(info.Params) > 0 {
+			params[info.Name] = info.Params
+		}
+	}
+	return params
+}()
+
+// 命令ID到命令名的反查表
+var sportCmdNames = func() map[int]string {
+	names := make(map[int]string, len(SportCmd))
+	for name, id := range SportCmd {
+		names[id] = name
+	}
+	return names
+}()
+
+// SportCommand 运动命令，值为命令ID，只能通过LookupCommand获得有效值
+type SportCommand int
+
+// LookupCommand 按名称查找运动命令
+func LookupCommand(name string) (SportCommand, bool) {
+	id, exists := SportCmd[name]
+	return SportCommand(id), exists
+}
+
+// Name 命令名，未知命令返回空字符串
+func (cmd SportCommand) Name() string {
+	return sportCmdNames[int(cmd)]
+}
+
+// ID 命令ID，即请求中的api_id
+func (cmd SportCommand) ID() int {
+	return int(cmd)
+}
+
+// RequiresParameter 命令是否需要参数
+func (cmd SportCommand) RequiresParameter() bool {
+	_, needParams := sportCmdParams[cmd.Name()]
+	return needParams
+}
+
+func (cmd SportCommand) String() string {
+	if name := cmd.Name(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("SportCommand(%d)", int(cmd))
 }
 
 // Go2Connection 机器人连接结构体
 type Go2Connection struct {
-	ip               string
-	token            string
-	peerConnection   *webrtc.PeerConnection
-	dataChannel      *webrtc.DataChannel
-	validationResult string
-	onValidated      func()
-	onMessage        func(message interface{}, msgObj interface{})
-	onOpen           func()
-	heartbeatTimer   *time.Timer
-	validationKey    string // 保存验证密钥
+	ip                    string
+	token                 string
+	peerConnection        *webrtc.PeerConnection
+	dataChannel           *webrtc.DataChannel
+	validationResult      string
+	onValidated           func()
+	onMessage             func(message interface{}, msgObj interface{})
+	onOpen                func()
+	onVideo               func(packet rtp.Packet)
+	videoSSRC             atomic.Uint32 // 机器人视频轨道的SSRC，用于发送PLI
+	handlers              connHandlers  // 可在运行中替换的回调
+	handlersMu            sync.Mutex
+	subscriptions         map[string]func(message Message) // 话题订阅及其处理函数
+	subscriptionsMu       sync.Mutex
+	pendingRequests       map[int]chan Message // 等待响应的请求，按请求id索引
+	lastRequestID         atomic.Uint32        // 最近分配的请求id，所有命令共用以保证id不重复
+	pendingMu             sync.Mutex
+	heartbeatTimer        *time.Timer
+	heartbeatInterval     time.Duration
+	heartbeatMu           sync.Mutex
+	joystickMu            sync.Mutex
+	joystickParams        MoveParams // 最近一次摇杆速度
+	joystickUpdated       time.Time
+	joystickDeadman       time.Duration
+	joystickStop          chan struct{} // 摇杆循环运行时非nil
+	emergencyCommands     map[string]bool
+	emergencyMu           sync.Mutex
+	commandTopics         map[string]string // 发布到非默认话题的命令
+	commandTopicsMu       sync.Mutex
+	events                []ConnectionEvent // 环形缓冲，eventsNext为下一个写入位置
+	eventsNext            int
+	eventsMu              sync.Mutex
+	commandHistory        []CommandRecord // 环形缓冲，commandNext为下一个写入位置
+	commandNext           int
+	commandMu             sync.Mutex
+	connectionTimeout     time.Duration
+	signalingPort         int
+	httpTimeout           time.Duration
+	settingsMu            sync.Mutex    // 保护ip、token、握手设置和回调工作协程设置
+	channelOpen           chan struct{} // 数据通道打开时关闭
+	channelOpenOnce       sync.Once
+	maxBufferedAmount     atomic.Uint64
+	maxMessageSize        atomic.Int64
+	callbacks             chan func() // 待执行的消息回调，队列满时丢弃最旧的
+	callbackWorkers       int
+	callbackQueueSize     int
+	callbackWorkersOnce   sync.Once
+	closed                chan struct{} // Close时关闭，通知回调工作协程退出
+	closeOnce             sync.Once
+	bufferedLow           chan struct{} // 发送缓冲降到低水位时关闭并替换，唤醒所有等待者
+	bufferedLowMu         sync.Mutex
+	connectTimings        ConnectTimings // 最近一次连接的各阶段耗时
+	connectTimingsMu      sync.Mutex
+	connecting            atomic.Bool // 正在执行握手
+	handshakeCipher       string
+	sdpMunge              SDPMungeOptions
+	logger                atomic.Pointer[Logger]
+	validationKey         string        // 保存验证密钥
+	validationRetries     int           // 收到Validation Needed后已重试的次数
+	validationMu          sync.Mutex    // 保护validationResult、validationKey和validationRetries
+	validationDone        chan struct{} // 验证成功或重试耗尽时关闭
+	validationDoneOnce    sync.Once
+	maxValidationAttempts int
+	commandAckRetries     atomic.Int64
+	validationBackoff     time.Duration
+}
+
+// connHandlers 注册后可在运行中替换的回调，由handlersMu保护
+type connHandlers struct {
+	onTelemetry        func(topic string, payload interface{})
+	onStateChange      func(state string)
+	onValidationFailed func(err error)
+	onRobotError       func(message Message)
+}
+
+// connectSettings 一次连接使用的地址和握手设置，连接开始时复制以免被并发修改
+type connectSettings struct {
+	ip                string
+	token             string
+	connectionTimeout time.Duration
+	signalingPort     int
+	httpTimeout       time.Duration
+	sdpMunge          SDPMungeOptions
+	handshakeCipher   string
 }
 
 // Message 消息结构体
 type Message struct {
 	Type  string      `json:"type"`
 	Topic string      `json:"topic"`
-	Data  interface{} `json:"data"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// IMUState IMU状态
+type IMUState struct {
+	Quaternion    []float64 `json:"quaternion"`
+	Gyroscope     []float64 `json:"gyroscope"`
+	Accelerometer []float64 `json:"accelerometer"`
+	RPY           []float64 `json:"rpy"`
+	Temperature   int       `json:"temperature"`
+}
+
+// MotorState 电机状态
+type MotorState struct {
+	Q           float64 `json:"q"`
+	Temperature int     `json:"temperature"`
+	Lost        int     `json:"lost"`
+}
+
+// BMSState 电池管理系统状态
+type BMSState struct {
+	VersionHigh int   `json:"version_high"`
+	VersionLow  int   `json:"version_low"`
+	Status      int   `json:"status"`
+	SOC         int   `json:"soc"`
+	Current     int   `json:"current"`
+	Cycle       int   `json:"cycle"`
+	BqNTC       []int `json:"bq_ntc"`
+	McuNTC      []int `json:"mcu_ntc"`
+}
+
+// LowState rt/lf/lowstate话题数据
+type LowState struct {
+	IMUState        IMUState     `json:"imu_state"`
+	MotorState      []MotorState `json:"motor_state"`
+	BMSState        BMSState     `json:"bms_state"`
+	FootForce       []int        `json:"foot_force"`
+	TemperatureNTC1 int          `json:"temperature_ntc1"`
+	PowerV          float64      `json:"power_v"`
+}
+
+// SportModeState rt/lf/sportmodestate话题数据
+type SportModeState struct {
+	Mode             int       `json:"mode"`
+	Progress         float64   `json:"progress"`
+	GaitType         int       `json:"gait_type"`
+	FootRaiseHeight  float64   `json:"foot_raise_height"`
+	Position         []float64 `json:"position"`
+	BodyHeight       float64   `json:"body_height"`
+	Velocity         []float64 `json:"velocity"`
+	YawSpeed         float64   `json:"yaw_speed"`
+	RangeObstacle    []float64 `json:"range_obstacle"`
+	IMUState         IMUState  `json:"imu_state"`
+	FootForce        []int     `json:"foot_force"`
+	FootPositionBody []float64 `json:"foot_position_body"`
+	FootSpeedBody    []float64 `json:"foot_speed_body"`
+}
+
+// 话题到数据结构的映射，用于解码遥测消息
+var telemetryTypes = map[string]func() interface{}{
+	LowStateTopic:       func() interface{} { return &LowState{} },
+	SportModeStateTopic: func() interface{} { return &SportModeState{} },
+}
+
+// CommandRecord 已发送或被拒绝的命令
+type CommandRecord struct {
+	Time      time.Time   `json:"time"`
+	Command   string      `json:"command"`
+	Data      interface{} `json:"data,omitempty"`
+	RequestID int         `json:"request_id,omitempty"`
+	Rejected  bool        `json:"rejected"`        // 参数校验或发送失败，命令未到达机器人
+	Error     string      `json:"error,omitempty"` // 被拒绝的原因
+}
+
+// ConnectTimings 连接各阶段耗时(毫秒)
+type ConnectTimings struct {
+	OfferMs       int64 `json:"offerMs"`       // 创建提议并收集ICE候选
+	ConNotifyMs   int64 `json:"conNotifyMs"`   // con_notify请求
+	ConIngMs      int64 `json:"conIngMs"`      // con_ing加密请求
+	SetRemoteMs   int64 `json:"setRemoteMs"`   // 设置远程描述
+	ChannelOpenMs int64 `json:"channelOpenMs"` // 等待数据通道打开
+	TotalMs       int64 `json:"totalMs"`
+}
+
+// MoveParams Move命令参数
+type MoveParams struct {
+	X float64 `json:"x"` // 前后速度，向前为正
+	Y float64 `json:"y"` // 左右速度，向左为正
+	Z float64 `json:"z"` // 转向角速度，逆时针为正
+}
+
+// Validate 检查速度是否在安全范围内(含边界)
+func (params MoveParams) Validate() error {
+	if math.IsNaN(params.X) || params.X < moveMinX || params.X > moveMaxX {
+		return fmt.Errorf("x超出范围[%v, %v]: %v", moveMinX, moveMaxX, params.X)
+	}
+	if math.IsNaN(params.Y) || params.Y < moveMinY || params.Y > moveMaxY {
+		return fmt.Errorf("y超出范围[%v, %v]: %v", moveMinY, moveMaxY, params.Y)
+	}
+	if math.IsNaN(params.Z) || params.Z < moveMinZ || params.Z > moveMaxZ {
+		return fmt.Errorf("z超出范围[%v, %v]: %v", moveMinZ, moveMaxZ, params.Z)
+	}
+	return nil
+}
+
+// RobotConnState 机器人连接状态
+type RobotConnState int
+
+const (
+	RobotConnDisconnected RobotConnState = iota
+	RobotConnConnecting
+	RobotConnValidating
+	RobotConnReady
+	RobotConnFailed
+)
+
+func (state RobotConnState) String() string {
+	switch state {
+	case RobotConnConnecting:
+		return "connecting"
+	case RobotConnValidating:
+		return "validating"
+	case RobotConnReady:
+		return "ready"
+	case RobotConnFailed:
+		return "failed"
+	default:
+		return "disconnected"
+	}
+}
+
+// ConnectionEvent 连接状态变化事件
+type ConnectionEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"` // peer/ice/datachannel/validation/video
+	Detail string    `json:"detail"`
+}
+
+// SDPMungeOptions 发送给机器人的提议SDP改写选项，零值表示不改写
+type SDPMungeOptions struct {
+	VideoBitrateKbps  int      // 大于0时在视频段写入b=AS限制码率
+	PreferredCodecs   []string // 视频编码优先顺序，如H264
+	RemoveOtherCodecs bool     // 移除PreferredCodecs以外的视频编码(保留其RTX)
+}
+
+// ConnectionOptions 创建PeerConnection时使用的选项，零值与pion默认行为一致
+type ConnectionOptions struct {
+	DisableMDNS bool   // 不收集也不解析mDNS .local候选
+	DisableIPv6 bool   // 只使用IPv4候选，pion默认同时启用IPv4和IPv6
+	UDPPortMin  uint16 // ICE使用的UDP端口范围，两者均为0时不限制
+	UDPPortMax  uint16
+
+	// 数据通道可靠性，零值为有序可靠传输；控制和遥测共用同一数据通道
+	// 高频摇杆控制可设为无序并限制重传，过时的Move不必送达
+	DataChannelUnordered         bool
+	DataChannelMaxRetransmits    *uint16 // 与DataChannelMaxPacketLifeTime互斥
+	DataChannelMaxPacketLifeTime *uint16 // 毫秒
+
+	// 非空时只注册使用该fmtp的H264(及其RTX)，替代pion默认编码表
+	// 如"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+	H264FmtpLine string
+}
+
+// Validate 检查选项取值
+func (opts ConnectionOptions) Validate() error {
+	portRangeSet := opts.UDPPortMin != 0 || opts.UDPPortMax != 0
+	if portRangeSet && (opts.UDPPortMin == 0 || opts.UDPPortMin >= opts.UDPPortMax) {
+		return fmt.Errorf("UDP端口范围无效: %d-%d", opts.UDPPortMin, opts.UDPPortMax)
+	}
+	if opts.DataChannelMaxRetransmits != nil && opts.DataChannelMaxPacketLifeTime != nil {
+		return fmt.Errorf("DataChannelMaxRetransmits和DataChannelMaxPacketLifeTime不能同时设置")
+	}
+	if opts.H264FmtpLine != "" {
+		if err := validateFmtpLine(opts.H264FmtpLine); err != nil {
+			return fmt.Errorf("H264FmtpLine无效: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateFmtpLine 检查fmtp参数为分号分隔的key=value
+func validateFmtpLine(line string) error {
+	for _, param := range strings.Split(line, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found || key == "" || value == "" {
+			return fmt.Errorf("参数 %q 不是key=value格式", param)
+		}
+		for _, r := range key {
+			if !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				return fmt.Errorf("参数名 %q 含非法字符", key)
+			}
+		}
+
+		switch key {
+		case "profile-level-id":
+			if _, err := hex.DecodeString(value); err != nil || len(value) != 6 {
+				return fmt.Errorf("profile-level-id必须是6位十六进制: %s", value)
+			}
+		case "packetization-mode":
+			if value != "0" && value != "1" && value != "2" {
+				return fmt.Errorf("packetization-mode必须是0、1或2: %s", value)
+			}
+		}
+	}
+	return nil
+}
+
+// registerH264Codec 注册使用指定fmtp的H264及其RTX，负载类型与pion默认的H264一致
+func registerH264Codec(mediaEngine *webrtc.MediaEngine, fmtpLine string) error {
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: fmtpLine, RTCPFeedback: feedback},
+			PayloadType:        102,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: "apt=102"},
+			PayloadType:        121,
+		},
+	} {
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newWebRTCAPI 按选项构建webrtc.API，未设置H264FmtpLine时编解码器和拦截器与webrtc.NewPeerConnection默认一致
+func newWebRTCAPI(opts ConnectionOptions) (*webrtc.API, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if opts.H264FmtpLine != "" {
+		if err := registerH264Codec(mediaEngine, opts.H264FmtpLine); err != nil {
+			return nil, fmt.Errorf("注册H264编码失败: %v", err)
+		}
+	} else if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("注册编解码器失败: %v", err)
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, fmt.Errorf("注册拦截器失败: %v", err)
+	}
+
+	settingEngine, err := newSettingEngine(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine),
+	), nil
+}
+
+// newSettingEngine 按选项设置ICE候选收集，未设置的选项保持pion默认值
+func newSettingEngine(opts ConnectionOptions) (webrtc.SettingEngine, error) {
+	settingEngine := webrtc.SettingEngine{}
+	if opts.DisableMDNS {
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	}
+	if opts.DisableIPv6 {
+		// pion默认只收集UDP4和UDP6候选，去掉UDP6即可
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	}
+	if opts.UDPPortMax != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(opts.UDPPortMin, opts.UDPPortMax); err != nil {
+			return settingEngine, fmt.Errorf("设置UDP端口范围失败: %v", err)
+		}
+	}
+	return settingEngine, nil
 }
 
 // SDPOffer SDP提议结构体
@@ -97,8 +681,19 @@ type SDPOffer struct {
 	Token string `json:"token"`
 }
 
-// NewGo2Connection 创建新的Go2连接
-func NewGo2Connection(ip, token string, onValidated func(), onMessage func(message interface{}, msgObj interface{}), onOpen func()) *Go2Connection {
+// NewGo2Connection 创建新的Go2连接，机器人IP和令牌在Connect时传入
+// onValidated和onMessage在回调工作协程中执行，不阻塞数据通道读取
+func NewGo2Connection(onValidated func(), onMessage func(message interface{}, msgObj interface{}), onOpen func(), onVideo func(packet rtp.Packet)) (*Go2Connection, error) {
+	return NewGo2ConnectionWithOptions(ConnectionOptions{}, onValidated, onMessage, onOpen, onVideo)
+}
+
+// NewGo2ConnectionWithOptions 按opts创建PeerConnection，其余同NewGo2Connection
+func NewGo2ConnectionWithOptions(opts ConnectionOptions, onValidated func(), onMessage func(message interface{}, msgObj interface{}), onOpen func(), onVideo func(packet rtp.Packet)) (*Go2Connection, error) {
+	api, err := newWebRTCAPI(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	config := webrtc.Configuration{
 		// ICEServers: []webrtc.ICEServer{
 		// 	{
@@ -107,36 +702,67 @@ func NewGo2Connection(ip, token string, onValidated func(), onMessage func(messa
 		// },
 	}
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(config)
 	if err != nil {
-		log.Fatal("创建PeerConnection失败:", err)
+		return nil, fmt.Errorf("创建PeerConnection失败: %v", err)
 	}
 
 	conn := &Go2Connection{
-		ip:               ip,
-		token:            token,
-		peerConnection:   peerConnection,
-		validationResult: "PENDING",
-		onValidated:      onValidated,
-		onMessage:        onMessage,
-		onOpen:           onOpen,
+		peerConnection:        peerConnection,
+		validationResult:      "PENDING",
+		onValidated:           onValidated,
+		onMessage:             onMessage,
+		onOpen:                onOpen,
+		onVideo:               onVideo,
+		heartbeatInterval:     defaultHeartbeatInterval,
+		maxValidationAttempts: defaultMaxValidationAttempts,
+		validationBackoff:     defaultValidationBackoff,
+		joystickDeadman:       defaultJoystickDeadman,
+		emergencyCommands:     map[string]bool{"Damp": true, "StopMove": true},
+		connectionTimeout:     defaultConnectionTimeout,
+		signalingPort:         defaultRobotSignalingPort,
+		httpTimeout:           defaultRobotHTTPTimeout,
+		channelOpen:           make(chan struct{}),
+		validationDone:        make(chan struct{}),
+		callbackWorkers:       defaultCallbackWorkers,
+		callbackQueueSize:     defaultCallbackQueueSize,
+		closed:                make(chan struct{}),
+		bufferedLow:           make(chan struct{}),
+		handshakeCipher:       HandshakeCipherECB,
+		subscriptions:         make(map[string]func(message Message)),
+		pendingRequests:       make(map[int]chan Message),
 	}
 
+	logger := defaultLogger
+	conn.logger.Store(&logger)
+	conn.maxBufferedAmount.Store(defaultMaxBufferedAmount)
+	conn.maxMessageSize.Store(defaultMaxMessageSize)
+	conn.commandAckRetries.Store(defaultCommandAckRetries)
+
+	// 请求id从当前毫秒时间开始递增，与Python版本的id格式一致
+	conn.lastRequestID.Store(uint32(generate_id()))
+
 	// 创建数据通道
 	dataChannelInit := webrtc.DataChannelInit{
-		ID:         func() *uint16 { id := uint16(1); return &id }(),
-		Negotiated: func() *bool { negotiated := false; return &negotiated }(),
+		ID:                func() *uint16 { id := uint16(1); return &id }(),
+		Negotiated:        func() *bool { negotiated := false; return &negotiated }(),
+		Ordered:           func() *bool { ordered := !opts.DataChannelUnordered; return &ordered }(),
+		MaxRetransmits:    opts.DataChannelMaxRetransmits,
+		MaxPacketLifeTime: opts.DataChannelMaxPacketLifeTime,
 	}
 	dataChannel, err := peerConnection.CreateDataChannel("data", &dataChannelInit)
 	if err != nil {
-		log.Fatal("创建数据通道失败:", err)
+		peerConnection.Close()
+		return nil, fmt.Errorf("创建数据通道失败: %v", err)
 	}
 
 	conn.dataChannel = dataChannel
 
 	// 设置数据通道事件处理
 	dataChannel.OnOpen(func() {
-		log.Println("数据通道已打开")
+		conn.getLogger().Infof("数据通道已打开")
+		conn.recordEvent("datachannel", "open")
+		conn.channelOpenOnce.Do(func() { close(conn.channelOpen) })
 		// 在数据通道打开后立即启动心跳
 		conn.startHeartbeat()
 		if conn.onOpen != nil {
@@ -145,47 +771,121 @@ func NewGo2Connection(ip, token string, onValidated func(), onMessage func(messa
 	})
 
 	dataChannel.OnClose(func() {
-		log.Println("数据通道已关闭")
+		conn.getLogger().Infof("数据通道已关闭")
+		conn.recordEvent("datachannel", "closed")
 		conn.stopHeartbeat()
+		conn.stopJoystickLoop()
+	})
+
+	// 发送缓冲降到低水位时唤醒等待发送的消息
+	dataChannel.SetBufferedAmountLowThreshold(lowThreshold(defaultMaxBufferedAmount))
+	dataChannel.OnBufferedAmountLow(func() {
+		conn.bufferedLowMu.Lock()
+		close(conn.bufferedLow)
+		conn.bufferedLow = make(chan struct{})
+		conn.bufferedLowMu.Unlock()
 	})
 
 	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
 		conn.handleDataChannelMessage(msg)
 	})
 
+	peerConnection.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		conn.recordEvent("ice", s.String())
+	})
+
+	// 只接收机器人的视频
+	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		peerConnection.Close()
+		return nil, fmt.Errorf("添加视频收发器失败: %v", err)
+	}
+
+	// 接收机器人发来的视频轨道
+	peerConnection.OnTrack(conn.handleTrack)
+
 	// 设置连接状态变化处理
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		log.Printf("连接状态: %s", s.String())
+		conn.getLogger().Infof("连接状态: %s", s.String())
+		conn.recordEvent("peer", s.String())
+		if onStateChange := conn.getHandlers().onStateChange; onStateChange != nil {
+			onStateChange(s.String())
+		}
 	})
 
-	return conn
+	return conn, nil
+}
+
+// handleTrack 读取远端视频轨道的RTP包并转发给onVideo
+func (conn *Go2Connection) handleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if track.Kind() != webrtc.RTPCodecTypeVideo {
+		conn.getLogger().Debugf("忽略非视频轨道: %s", track.Kind().String())
+		return
+	}
+	conn.getLogger().Infof("收到视频轨道: %s", track.Codec().MimeType)
+	conn.recordEvent("video", "track "+track.Codec().MimeType)
+	conn.videoSSRC.Store(uint32(track.SSRC()))
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				conn.getLogger().Infof("视频轨道已结束")
+				conn.recordEvent("video", "ended")
+			} else {
+				conn.getLogger().Warnf("读取视频RTP包失败: %v", err)
+			}
+			return
+		}
+		if conn.onVideo != nil {
+			conn.onVideo(*packet)
+		}
+	}
+}
+
+// RequestKeyframe 向机器人发送PLI请求关键帧，新观看者加入时调用可缩短黑屏时间
+func (conn *Go2Connection) RequestKeyframe() error {
+	ssrc := conn.videoSSRC.Load()
+	if ssrc == 0 {
+		return fmt.Errorf("尚未收到视频轨道")
+	}
+	return conn.peerConnection.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: ssrc},
+	})
 }
 
 // handleDataChannelMessage 处理数据通道消息
 func (conn *Go2Connection) handleDataChannelMessage(msg webrtc.DataChannelMessage) {
+	if limit := conn.maxMessageSize.Load(); int64(len(msg.Data)) > limit {
+		conn.getLogger().Warnf("消息大小%d字节超过上限%d字节，已丢弃", len(msg.Data), limit)
+		conn.recordEvent("datachannel", fmt.Sprintf("oversized message dropped: %d bytes", len(msg.Data)))
+		return
+	}
+
 	if msg.IsString {
 		var messageObj Message
 		if err := json.Unmarshal(msg.Data, &messageObj); err != nil {
-			log.Printf("解析消息失败: %v", err)
+			conn.getLogger().Warnf("解析消息失败: %v", err)
 			return
 		}
-		log.Printf("handleDataChannelMessage: %v", messageObj)
+		conn.getLogger().Debugf("handleDataChannelMessage: %v", messageObj)
+		handlers := conn.getHandlers()
 
 		// 检查是否是错误消息
 		if messageObj.Type == "err" || messageObj.Type == "errors" {
-			log.Printf("收到错误消息: %v", messageObj.Data)
+			conn.getLogger().Warnf("收到错误消息: %v", messageObj.Data)
+			if handlers.onRobotError != nil {
+				conn.deliver(func() { handlers.onRobotError(messageObj) })
+			}
 			// 处理验证相关的错误
 			if errData, ok := messageObj.Data.(map[string]interface{}); ok {
 				if info, exists := errData["info"]; exists && info == "Validation Needed." {
-					log.Println("收到验证需要错误，重新发送验证数据")
-					// 重新发送验证数据
-					if conn.validationResult != "SUCCESS" && conn.validationKey != "" {
-						conn.sendValidationData(conn.validationKey)
-					}
+					conn.retryValidation()
 				}
 			} else {
 				// 如果Data为nil，记录完整的错误消息
-				log.Printf("错误消息Data为nil，完整消息: %+v", messageObj)
+				conn.getLogger().Warnf("错误消息Data为nil，完整消息: %+v", messageObj)
 			}
 			return
 		}
@@ -194,50 +894,315 @@ func (conn *Go2Connection) handleDataChannelMessage(msg webrtc.DataChannelMessag
 			conn.validate(messageObj)
 		}
 
-		if conn.onMessage != nil {
-			conn.onMessage(string(msg.Data), messageObj)
-		}
+		conn.dispatchResponse(messageObj)
+
+		// 用户回调交给工作协程执行，避免慢回调阻塞数据通道读取
+		conn.deliver(func() {
+			if messageObj.Type == MessageType && handlers.onTelemetry != nil {
+				conn.handleTelemetry(messageObj.Topic, msg.Data, handlers.onTelemetry)
+			}
+
+			if messageObj.Type == MessageType {
+				conn.subscriptionsMu.Lock()
+				handler := conn.subscriptions[messageObj.Topic]
+				conn.subscriptionsMu.Unlock()
+				if handler != nil {
+					handler(messageObj)
+				}
+			}
+
+			if conn.onMessage != nil {
+				conn.onMessage(string(msg.Data), messageObj)
+			}
+		})
 	} else {
 		// 机器人不支持二进制数据，记录警告
-		log.Printf("收到二进制数据，但机器人不支持二进制数据格式")
+		conn.getLogger().Warnf("收到二进制数据，但机器人不支持二进制数据格式")
+	}
+}
+
+// deliver 将回调放入队列，队列已满时丢弃最旧的回调
+func (conn *Go2Connection) deliver(callback func()) {
+	conn.callbackWorkersOnce.Do(conn.startCallbackWorkers)
+	for {
+		select {
+		case conn.callbacks <- callback:
+			return
+		default:
+		}
+
+		select {
+		case <-conn.callbacks:
+			conn.getLogger().Warnf("消息回调队列已满(%d)，丢弃最旧的消息", cap(conn.callbacks))
+		default:
+		}
+	}
+}
+
+// startCallbackWorkers 创建回调队列并启动工作协程，Close后退出
+func (conn *Go2Connection) startCallbackWorkers() {
+	conn.settingsMu.Lock()
+	workers, queueSize := conn.callbackWorkers, conn.callbackQueueSize
+	conn.settingsMu.Unlock()
+
+	conn.callbacks = make(chan func(), queueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case callback := <-conn.callbacks:
+					callback()
+				case <-conn.closed:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// OnConnectionStateChange 注册连接状态变化回调，state为new/connecting/connected/disconnected/failed/closed
+func (conn *Go2Connection) OnConnectionStateChange(handler func(state string)) {
+	conn.handlersMu.Lock()
+	conn.handlers.onStateChange = handler
+	conn.handlersMu.Unlock()
+}
+
+// OnRobotError 注册机器人错误消息(err/errors类型)的回调，回调在工作协程中执行
+func (conn *Go2Connection) OnRobotError(handler func(message Message)) {
+	conn.handlersMu.Lock()
+	conn.handlers.onRobotError = handler
+	conn.handlersMu.Unlock()
+}
+
+// OnValidationFailed 注册验证重试耗尽时的回调，此时心跳已停止，回调在工作协程中执行
+func (conn *Go2Connection) OnValidationFailed(handler func(err error)) {
+	conn.handlersMu.Lock()
+	conn.handlers.onValidationFailed = handler
+	conn.handlersMu.Unlock()
+}
+
+// SetValidationRetry 设置验证最大重试次数和初始退避时间
+func (conn *Go2Connection) SetValidationRetry(maxAttempts int, backoff time.Duration) {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxValidationAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultValidationBackoff
+	}
+	conn.validationMu.Lock()
+	conn.maxValidationAttempts = maxAttempts
+	conn.validationBackoff = backoff
+	conn.validationMu.Unlock()
+}
+
+// OnTelemetry 注册遥测回调，已知话题的数据解码为对应结构体后传入
+func (conn *Go2Connection) OnTelemetry(handler func(topic string, payload interface{})) {
+	conn.handlersMu.Lock()
+	conn.handlers.onTelemetry = handler
+	conn.handlersMu.Unlock()
+}
+
+// getHandlers 返回当前回调的副本，调用回调时不持有锁
+func (conn *Go2Connection) getHandlers() connHandlers {
+	conn.handlersMu.Lock()
+	defer conn.handlersMu.Unlock()
+	return conn.handlers
+}
+
+// handleTelemetry 按话题解码遥测消息，未知话题只通过onMessage传递
+func (conn *Go2Connection) handleTelemetry(topic string, raw []byte, onTelemetry func(topic string, payload interface{})) {
+	newPayload, exists := telemetryTypes[topic]
+	if !exists {
+		return
+	}
+
+	payload := newPayload()
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{Data: payload}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		conn.getLogger().Warnf("解码遥测消息失败(%s): %v", topic, err)
+		return
 	}
+	onTelemetry(topic, payload)
 }
 
 // validate 验证处理
 func (conn *Go2Connection) validate(message Message) {
-	log.Printf("验证消息: %v", message)
+	conn.getLogger().Debugf("验证消息: %v", message)
 	if data, ok := message.Data.(string); ok && data == "Validation Ok." {
+		conn.validationMu.Lock()
 		conn.validationResult = "SUCCESS"
-		log.Println("验证成功，启动心跳")
+		conn.validationRetries = 0
+		conn.validationMu.Unlock()
+		conn.validationDoneOnce.Do(func() { close(conn.validationDone) })
+		conn.getLogger().Infof("验证成功，启动心跳")
+		conn.recordEvent("validation", "success")
 		// 验证成功后启动心跳
 		conn.startHeartbeat()
-		if conn.onValidated != nil {
-			conn.onValidated()
-		}
+		// 发送可能等待发送缓冲，不在数据通道读取协程中执行
+		go func() {
+			// 通知机器人开始发送视频
+			conn.publish("", "on", VideoType)
+			// 重新发送已有的订阅，之后再通知用户
+			conn.resubscribe()
+			if conn.onValidated != nil {
+				conn.deliver(conn.onValidated)
+			}
+		}()
 	} else {
 		// 发送加密的验证数据
 		if data, ok := message.Data.(string); ok {
+			conn.validationMu.Lock()
 			conn.validationKey = data // 保存验证密钥
+			conn.validationMu.Unlock()
 			conn.sendValidationData(data)
 		} else {
-			log.Printf("验证消息数据不是字符串类型: %T", message.Data)
+			conn.getLogger().Warnf("验证消息数据不是字符串类型: %T", message.Data)
 		}
 	}
 }
 
-// sendValidationData 发送验证数据
-func (conn *Go2Connection) sendValidationData(key string) {
-	encryptedData := conn.encryptKey(key)
-	conn.publish("", encryptedData, ValidationType)
-}
+// retryValidation 收到Validation Needed时按指数退避重发验证数据，超过次数后放弃
+func (conn *Go2Connection) retryValidation() {
+	conn.validationMu.Lock()
+	if conn.validationResult != "PENDING" || conn.validationKey == "" {
+		conn.validationMu.Unlock()
+		return
+	}
 
-// publish 发布消息
-func (conn *Go2Connection) publish(topic string, data interface{}, msgType string) {
-	if conn.dataChannel == nil || conn.dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
-		log.Printf("数据通道未打开，无法发送消息")
+	if conn.validationRetries >= conn.maxValidationAttempts {
+		err := fmt.Errorf("%w: 重试%d次后仍未通过", ErrValidationFailed, conn.validationRetries)
+		conn.validationResult = "FAILED"
+		conn.validationMu.Unlock()
+		conn.validationDoneOnce.Do(func() { close(conn.validationDone) })
+
+		conn.getLogger().Errorf("%v", err)
+		conn.recordEvent("validation", "failed")
+		conn.stopHeartbeat()
+		conn.stopJoystickLoop()
+		if onValidationFailed := conn.getHandlers().onValidationFailed; onValidationFailed != nil {
+			conn.deliver(func() { onValidationFailed(err) })
+		}
 		return
 	}
 
+	delay := conn.validationBackoff << conn.validationRetries
+	conn.validationRetries++
+	attempt := conn.validationRetries
+	key := conn.validationKey
+	conn.validationMu.Unlock()
+
+	conn.getLogger().Infof("收到验证需要错误，%v后第%d次重新发送验证数据", delay, attempt)
+	time.AfterFunc(delay, func() {
+		if conn.getValidationResult() == "PENDING" {
+			conn.sendValidationData(key)
+		}
+	})
+}
+
+// getValidationResult 返回当前验证结果: PENDING/SUCCESS/FAILED
+func (conn *Go2Connection) getValidationResult() string {
+	conn.validationMu.Lock()
+	defer conn.validationMu.Unlock()
+	return conn.validationResult
+}
+
+// sendValidationData 发送验证数据
+func (conn *Go2Connection) sendValidationData(key string) {
+	encryptedData := conn.encryptKey(key)
+	conn.publish("", encryptedData, ValidationType)
+}
+
+// Publish 向任意话题发布消息，如rt/api/obstacles_avoid/request
+func (conn *Go2Connection) Publish(topic string, data interface{}) error {
+	if topic == "" {
+		return fmt.Errorf("话题不能为空")
+	}
+	return conn.publish(topic, data, MessageType)
+}
+
+// Subscribe 订阅机器人话题，该话题的消息交给handler处理
+// 未验证时只记录订阅，验证成功后统一发送
+// Go2Connection不能重连，重连时用Subscriptions()在新连接上重新订阅
+func (conn *Go2Connection) Subscribe(topic string, handler func(message Message)) error {
+	if topic == "" {
+		return fmt.Errorf("话题不能为空")
+	}
+
+	conn.subscriptionsMu.Lock()
+	conn.subscriptions[topic] = handler
+	conn.subscriptionsMu.Unlock()
+
+	if !conn.IsReady() {
+		return nil
+	}
+	return conn.publish(topic, nil, SubscribeType)
+}
+
+// Unsubscribe 取消订阅机器人话题
+func (conn *Go2Connection) Unsubscribe(topic string) error {
+	conn.subscriptionsMu.Lock()
+	_, exists := conn.subscriptions[topic]
+	delete(conn.subscriptions, topic)
+	conn.subscriptionsMu.Unlock()
+
+	if !exists || !conn.IsReady() {
+		return nil
+	}
+	return conn.publish(topic, nil, UnsubscribeType)
+}
+
+// Subscriptions 返回当前订阅的快照，可在新连接上逐个Subscribe以恢复订阅
+func (conn *Go2Connection) Subscriptions() map[string]func(message Message) {
+	conn.subscriptionsMu.Lock()
+	defer conn.subscriptionsMu.Unlock()
+
+	snapshot := make(map[string]func(message Message), len(conn.subscriptions))
+	for topic, handler := range conn.subscriptions {
+		snapshot[topic] = handler
+	}
+	return snapshot
+}
+
+// resubscribe 验证成功后发送验证前登记的订阅
+func (conn *Go2Connection) resubscribe() {
+	conn.subscriptionsMu.Lock()
+	topics := make([]string, 0, len(conn.subscriptions))
+	for topic := range conn.subscriptions {
+		topics = append(topics, topic)
+	}
+	conn.subscriptionsMu.Unlock()
+
+	for _, topic := range topics {
+		conn.publish(topic, nil, SubscribeType)
+	}
+}
+
+// publish 发布消息
+func (conn *Go2Connection) publish(topic string, data interface{}, msgType string) error {
+	return conn.publishMessage(topic, data, msgType, false)
+}
+
+// publishMessage 发布消息，urgent为true时不等待发送缓冲回落
+func (conn *Go2Connection) publishMessage(topic string, data interface{}, msgType string, urgent bool) error {
+	return conn.publishGuarded(topic, data, msgType, urgent, nil)
+}
+
+// publishGuarded 同publishMessage，guard非nil时等待缓冲之后由guard决定是否调用send
+func (conn *Go2Connection) publishGuarded(topic string, data interface{}, msgType string, urgent bool, guard func(send func() error) error) error {
+	if conn.dataChannel == nil || conn.dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		conn.getLogger().Warnf("数据通道未打开，无法发送消息")
+		return fmt.Errorf("数据通道未打开")
+	}
+
+	if !urgent {
+		if err := conn.waitForBuffer(msgType); err != nil {
+			conn.getLogger().Warnf("%v", err)
+			return err
+		}
+	}
+
 	payload := Message{
 		Type:  msgType,
 		Topic: topic,
@@ -246,21 +1211,61 @@ func (conn *Go2Connection) publish(topic string, data interface{}, msgType strin
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("序列化消息失败: %v", err)
-		return
+		conn.getLogger().Errorf("序列化消息失败: %v", err)
+		return fmt.Errorf("序列化消息失败: %v", err)
 	}
 
 	// 记录原始payload，与Python版本保持一致
-	log.Printf("-> Sending message %s", string(jsonData))
+	conn.getLogger().Debugf("-> Sending message %s", string(jsonData))
 
 	// 发送消息
-	err = conn.dataChannel.SendText(string(jsonData))
-	if err != nil {
-		log.Printf("发送消息失败: %v", err)
-		return
+	send := func() error {
+		if err := conn.dataChannel.SendText(string(jsonData)); err != nil {
+			conn.getLogger().Errorf("发送消息失败: %v", err)
+			return fmt.Errorf("发送消息失败: %v", err)
+		}
+		return nil
+	}
+	if guard != nil {
+		return guard(send)
+	}
+	return send()
+}
+
+// waitForBuffer 发送缓冲超过上限时，丢弃心跳等低优先级消息，其余消息短暂等待缓冲回落
+func (conn *Go2Connection) waitForBuffer(msgType string) error {
+	limit := conn.maxBufferedAmount.Load()
+	if conn.dataChannel.BufferedAmount() <= limit {
+		return nil
+	}
+	if msgType == HeartbeatType {
+		return fmt.Errorf("发送缓冲已满，丢弃%s消息", msgType)
+	}
+
+	timer := time.NewTimer(backpressureWait)
+	defer timer.Stop()
+	for {
+		// 先取通知通道再检查缓冲，避免错过两者之间的低水位事件
+		conn.bufferedLowMu.Lock()
+		low := conn.bufferedLow
+		conn.bufferedLowMu.Unlock()
+		if conn.dataChannel.BufferedAmount() <= limit {
+			return nil
+		}
+
+		select {
+		case <-low:
+		case <-timer.C:
+			return fmt.Errorf("发送缓冲已满(%d字节)，消息未发送", conn.dataChannel.BufferedAmount())
+		}
 	}
 }
 
+// lowThreshold 返回发送缓冲上限对应的低水位，pion只在缓冲降过低水位时通知一次
+func lowThreshold(limit uint64) uint64 {
+	return min(limit, bufferedAmountLowThreshold)
+}
+
 // encryptKey 加密密钥
 func (conn *Go2Connection) encryptKey(key string) string {
 	prefixedKey := "UnitreeGo2_" + key
@@ -278,7 +1283,7 @@ func encryptByMD5(input string) string {
 func hexToBase64(hexStr string) string {
 	bytes, err := hex.DecodeString(hexStr)
 	if err != nil {
-		log.Printf("十六进制解码失败: %v", err)
+		defaultLogger.Errorf("十六进制解码失败: %v", err)
 		return ""
 	}
 	return base64.StdEncoding.EncodeToString(bytes)
@@ -311,8 +1316,8 @@ func unpad(data []byte) []byte {
 	return data[:length-padding]
 }
 
-// aesEncrypt AES加密
-func aesEncrypt(data, key string) string {
+// aesEncrypt AES加密，mode为HandshakeCipherECB或HandshakeCipherCBC
+func aesEncrypt(data, key, mode string) string {
 	keyBytes := []byte(key)
 	if len(keyBytes) > 32 {
 		keyBytes = keyBytes[:32]
@@ -322,11 +1327,24 @@ func aesEncrypt(data, key string) string {
 
 	block, err := aes.NewCipher(keyBytes)
 	if err != nil {
-		log.Printf("创建AES加密器失败: %v", err)
+		defaultLogger.Errorf("创建AES加密器失败: %v", err)
 		return ""
 	}
 
 	paddedData := pad([]byte(data), aes.BlockSize)
+
+	if mode == HandshakeCipherCBC {
+		// CBC模式加密，随机IV置于密文前
+		encrypted := make([]byte, aes.BlockSize+len(paddedData))
+		iv := encrypted[:aes.BlockSize]
+		if _, err := rand.Read(iv); err != nil {
+			defaultLogger.Errorf("生成IV失败: %v", err)
+			return ""
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted[aes.BlockSize:], paddedData)
+		return base64.StdEncoding.EncodeToString(encrypted)
+	}
+
 	encrypted := make([]byte, len(paddedData))
 
 	// ECB模式加密
@@ -337,8 +1355,8 @@ func aesEncrypt(data, key string) string {
 	return base64.StdEncoding.EncodeToString(encrypted)
 }
 
-// aesDecrypt AES解密
-func aesDecrypt(encryptedData, key string) string {
+// aesDecrypt AES解密，mode需与加密时一致
+func aesDecrypt(encryptedData, key, mode string) string {
 	keyBytes := []byte(key)
 	if len(keyBytes) > 32 {
 		keyBytes = keyBytes[:32]
@@ -348,295 +1366,1045 @@ func aesDecrypt(encryptedData, key string) string {
 
 	block, err := aes.NewCipher(keyBytes)
 	if err != nil {
-		log.Printf("创建AES解密器失败: %v", err)
+		defaultLogger.Errorf("创建AES解密器失败: %v", err)
 		return ""
 	}
 
 	encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedData)
 	if err != nil {
-		log.Printf("Base64解码失败: %v", err)
+		defaultLogger.Errorf("Base64解码失败: %v", err)
+		return ""
+	}
+
+	if len(encryptedBytes)%aes.BlockSize != 0 {
+		defaultLogger.Errorf("密文长度不是块大小的整数倍: %d", len(encryptedBytes))
+		return ""
+	}
+
+	if mode == HandshakeCipherCBC {
+		// CBC模式解密，密文前16字节为IV
+		if len(encryptedBytes) < 2*aes.BlockSize {
+			defaultLogger.Errorf("CBC密文过短: %d", len(encryptedBytes))
+			return ""
+		}
+		iv := encryptedBytes[:aes.BlockSize]
+		decrypted := make([]byte, len(encryptedBytes)-aes.BlockSize)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encryptedBytes[aes.BlockSize:])
+		return string(unpad(decrypted))
+	}
+
+	decrypted := make([]byte, len(encryptedBytes))
+
+	// ECB模式解密
+	for i := 0; i < len(encryptedBytes); i += aes.BlockSize {
+		block.Decrypt(decrypted[i:i+aes.BlockSize], encryptedBytes[i:i+aes.BlockSize])
+	}
+
+	unpadded := unpad(decrypted)
+	return string(unpadded)
+}
+
+// rsaLoadPublicKey 加载RSA公钥，支持机器人下发的Base64 DER和PEM格式
+// PEM块可为PUBLIC KEY(PKIX)或RSA PUBLIC KEY(PKCS#1)
+func rsaLoadPublicKey(pemData string) (*rsa.PublicKey, error) {
+	trimmed := strings.TrimSpace(pemData)
+
+	var keyBytes []byte
+	if strings.HasPrefix(trimmed, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(trimmed))
+		if block == nil {
+			return nil, fmt.Errorf("无效的PEM公钥")
+		}
+		if block.Type == "RSA PUBLIC KEY" {
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("不支持的PEM类型: %s", block.Type)
+		}
+		keyBytes = block.Bytes
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("公钥既不是PEM也不是有效的Base64: %w", err)
+		}
+		keyBytes = decoded
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析公钥失败: %w", err)
+	}
+
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("不是RSA公钥")
+}
+
+// rsaEncrypt RSA加密
+func rsaEncrypt(data string, publicKey *rsa.PublicKey) string {
+	dataBytes := []byte(data)
+	maxChunkSize := publicKey.Size() - 11
+	var encryptedBytes []byte
+
+	for i := 0; i < len(dataBytes); i += maxChunkSize {
+		end := i + maxChunkSize
+		if end > len(dataBytes) {
+			end = len(dataBytes)
+		}
+		chunk := dataBytes[i:end]
+
+		encryptedChunk, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, chunk)
+		if err != nil {
+			defaultLogger.Errorf("RSA加密失败: %v", err)
+			return ""
+		}
+		encryptedBytes = append(encryptedBytes, encryptedChunk...)
+	}
+
+	return base64.StdEncoding.EncodeToString(encryptedBytes)
+}
+
+// calcLocalPathEnding 计算本地路径结尾
+func calcLocalPathEnding(data1 string) string {
+	strArr := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J"}
+
+	if len(data1) < 10 {
 		return ""
 	}
 
-	decrypted := make([]byte, len(encryptedBytes))
+	last10Chars := data1[len(data1)-10:]
+	var arrayList []int
+
+	for i := 0; i < len(last10Chars); i += 2 {
+		if i+1 < len(last10Chars) {
+			secondChar := string(last10Chars[i+1])
+			for j, str := range strArr {
+				if str == secondChar {
+					arrayList = append(arrayList, j)
+					break
+				}
+			}
+		}
+	}
+
+	var result strings.Builder
+	for _, index := range arrayList {
+		result.WriteString(strconv.Itoa(index))
+	}
+
+	return result.String()
+}
+
+// makeLocalRequest 发送本地请求，ctx取消时请求立即中止
+func makeLocalRequest(ctx context.Context, path string, body io.Reader, headers map[string]string, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	return client.Do(req)
+}
+
+// getPeerAnswer 获取对等方应答
+// timings记录两次HTTP请求的耗时
+func (conn *Go2Connection) getPeerAnswer(ctx context.Context, sdpOffer *webrtc.SessionDescription, settings connectSettings, timings *ConnectTimings) (peerAnswer map[string]interface{}, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrHandshakeFailed, err)
+		}
+	}()
+
+	sdpOfferJSON := SDPOffer{
+		ID:    "STA_localNetwork",
+		SDP:   sdpOffer.SDP,
+		Type:  sdpOffer.Type.String(),
+		Token: settings.token,
+	}
+
+	newSDP, err := json.Marshal(sdpOfferJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://%s:%d/con_notify", settings.ip, settings.signalingPort)
+	start := time.Now()
+	resp, err := makeLocalRequest(ctx, url, nil, nil, settings.httpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("请求失败，状态码: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	timings.ConNotifyMs = time.Since(start).Milliseconds()
+
+	// 解码Base64响应
+	decodedResponse, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("con_notify响应不是有效的Base64: %w", err)
+	}
+
+	var decodedJSON map[string]interface{}
+	if err := json.Unmarshal(decodedResponse, &decodedJSON); err != nil {
+		return nil, fmt.Errorf("con_notify响应不是有效的JSON: %w", err)
+	}
+
+	conn.getLogger().Debugf("getPeerAnswer I newSDP: %s", string(newSDP))
+	conn.getLogger().Debugf("getPeerAnswer I url: %s", url)
+	conn.getLogger().Debugf("getPeerAnswer I resp: %s", decodedJSON)
+
+	rawData1, exists := decodedJSON["data1"]
+	if !exists {
+		return nil, fmt.Errorf("data1字段不存在")
+	}
+	data1, ok := rawData1.(string)
+	if !ok {
+		return nil, fmt.Errorf("data1字段不是字符串类型: %T", rawData1)
+	}
+	// data1由10位前缀、公钥和10位后缀组成
+	if len(data1) < 20 {
+		return nil, fmt.Errorf("data1长度不足: %d", len(data1))
+	}
+
+	// 提取公钥
+	publicKeyPEM := data1[10 : len(data1)-10]
+	pathEnding := calcLocalPathEnding(data1)
+
+	// 生成AES密钥
+	aesKey := generateAESKey()
+
+	// 加载公钥
+	publicKey, err := rsaLoadPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("加载机器人公钥失败: %w", err)
+	}
+
+	// 加密SDP和AES密钥
+	encryptedSDP := aesEncrypt(string(newSDP), aesKey, settings.handshakeCipher)
+	encryptedKey := rsaEncrypt(aesKey, publicKey)
+	if encryptedSDP == "" || encryptedKey == "" {
+		return nil, fmt.Errorf("加密SDP失败")
+	}
+	bodyData := map[string]string{
+		"data1": encryptedSDP,
+		"data2": encryptedKey,
+	}
+
+	bodyJSON, err := json.Marshal(bodyData)
+	if err != nil {
+		return nil, err
+	}
+
+	// 第二个请求的URL
+	url2 := fmt.Sprintf("http://%s:%d/con_ing_%s", settings.ip, settings.signalingPort, pathEnding)
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+
+	// 使用字符串形式的body，与Python版本一致
+	start = time.Now()
+	resp, err = makeLocalRequest(ctx, url2, strings.NewReader(string(bodyJSON)), headers, settings.httpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("加密请求失败，状态码: %d", resp.StatusCode)
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	timings.ConIngMs = time.Since(start).Milliseconds()
+
+	// 解密响应
+	decryptedResponse := aesDecrypt(strings.TrimSpace(string(body)), aesKey, settings.handshakeCipher)
+	if decryptedResponse == "" {
+		return nil, fmt.Errorf("解密con_ing响应失败")
+	}
+
+	if err := json.Unmarshal([]byte(decryptedResponse), &peerAnswer); err != nil {
+		return nil, fmt.Errorf("con_ing响应不是有效的JSON: %w", err)
+	}
+
+	conn.getLogger().Debugf("getPeerAnswer II url2: %s", url2)
+	conn.getLogger().Debugf("getPeerAnswer II headers: %s", headers)
+	conn.getLogger().Debugf("getPeerAnswer II resp.body: %s", string(decryptedResponse))
+	conn.getLogger().Debugf("getPeerAnswer II peerAnswer: %s", peerAnswer)
+
+	return peerAnswer, nil
+}
+
+// Connect 使用指定的IP和令牌连接到机器人
+func (conn *Go2Connection) Connect(ip, token string) error {
+	return conn.ConnectContext(context.Background(), ip, token)
+}
+
+// ConnectContext 使用指定的IP和令牌连接到机器人，ctx取消时中止握手并返回ctx的错误
+func (conn *Go2Connection) ConnectContext(ctx context.Context, ip, token string) error {
+	conn.settingsMu.Lock()
+	conn.ip = ip
+	conn.token = token
+	conn.settingsMu.Unlock()
+	return conn.connectRobot(ctx)
+}
+
+// ConnectRobot 使用上次Connect传入的IP和令牌连接到机器人，未设置IP时返回错误
+func (conn *Go2Connection) ConnectRobot() error {
+	return conn.connectRobot(context.Background())
+}
+
+// connectRobot 执行与机器人的握手流程
+// 握手、ICE连接和数据通道打开需在connectionTimeout内全部完成
+func (conn *Go2Connection) connectRobot(ctx context.Context) error {
+	settings := conn.getConnectSettings()
+	if settings.ip == "" {
+		return fmt.Errorf("未设置机器人IP，请使用Connect(ip, token)")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, settings.connectionTimeout)
+	defer cancel()
+
+	conn.connecting.Store(true)
+	defer conn.connecting.Store(false)
+
+	// 记录各阶段耗时，失败时也保留已完成阶段的数据
+	var timings ConnectTimings
+	connectStart := time.Now()
+	defer func() {
+		timings.TotalMs = time.Since(connectStart).Milliseconds()
+		conn.connectTimingsMu.Lock()
+		conn.connectTimings = timings
+		conn.connectTimingsMu.Unlock()
+		conn.getLogger().Infof("连接耗时: offer=%dms con_notify=%dms con_ing=%dms setRemote=%dms channelOpen=%dms total=%dms",
+			timings.OfferMs, timings.ConNotifyMs, timings.ConIngMs, timings.SetRemoteMs, timings.ChannelOpenMs, timings.TotalMs)
+	}()
+
+	// 创建提议
+	offer, err := conn.peerConnection.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOfferFailed, err)
+	}
+
+	// 设置本地描述
+	gatherComplete := webrtc.GatheringCompletePromise(conn.peerConnection)
+	err = conn.peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return fmt.Errorf("%w: 设置本地描述失败: %w", ErrOfferFailed, err)
+	}
+
+	// 等待ICE候选收集完成，最多占用一半的连接超时，超时则使用已收集到的部分候选
+	gatherTimeout := settings.connectionTimeout / 2
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		return connectTimeoutError(ctx, settings.connectionTimeout, "收集ICE候选")
+	case <-time.After(gatherTimeout):
+		conn.getLogger().Warnf("ICE候选收集超时(%v)，使用已收集的候选", gatherTimeout)
+	}
+
+	timings.OfferMs = time.Since(connectStart).Milliseconds()
+
+	sdp_offer := conn.peerConnection.LocalDescription()
+	sdp_offer.SDP = mungeSDP(sdp_offer.SDP, settings.sdpMunge)
+	conn.getLogger().Debugf("ConnectRobot I sdp_offer: %v", sdp_offer)
+
+	// 获取对等方应答
+	peerAnswer, err := conn.getPeerAnswer(ctx, sdp_offer, settings, &timings)
+	if err != nil {
+		if ctx.Err() != nil {
+			return connectTimeoutError(ctx, settings.connectionTimeout, "获取对等方应答")
+		}
+		return err
+	}
+
+	// 设置远程描述
+	rawSDP, exists := peerAnswer["sdp"]
+	if !exists {
+		return fmt.Errorf("%w: 应答中缺少SDP", ErrSDPFailed)
+	}
+	sdp, ok := rawSDP.(string)
+	if !ok || sdp == "" {
+		return fmt.Errorf("%w: 应答中的SDP无效: %v", ErrSDPFailed, rawSDP)
+	}
+
+	answer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	}
+
+	phaseStart := time.Now()
+	err = conn.peerConnection.SetRemoteDescription(answer)
+	if err != nil {
+		return fmt.Errorf("%w: 设置远程描述失败: %w", ErrSDPFailed, err)
+	}
+	timings.SetRemoteMs = time.Since(phaseStart).Milliseconds()
+
+	// 等待ICE连接建立、数据通道打开
+	phaseStart = time.Now()
+	select {
+	case <-conn.channelOpen:
+	case <-ctx.Done():
+		return connectTimeoutError(ctx, settings.connectionTimeout, "等待数据通道打开")
+	}
+	timings.ChannelOpenMs = time.Since(phaseStart).Milliseconds()
+
+	conn.getLogger().Infof("成功连接到机器人")
+	return nil
+}
+
+// getConnectSettings 复制当前的地址和握手设置
+func (conn *Go2Connection) getConnectSettings() connectSettings {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return connectSettings{
+		ip:                conn.ip,
+		token:             conn.token,
+		connectionTimeout: conn.connectionTimeout,
+		signalingPort:     conn.signalingPort,
+		httpTimeout:       conn.httpTimeout,
+		sdpMunge:          conn.sdpMunge,
+		handshakeCipher:   conn.handshakeCipher,
+	}
+}
+
+// connectTimeoutError 生成连接中止的错误，超时时说明卡在哪个阶段
+func connectTimeoutError(ctx context.Context, timeout time.Duration, stage string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("连接超时(%v): %s未完成: %w", timeout, stage, ctx.Err())
+	}
+	return ctx.Err()
+}
+
+// mungeSDP 按选项改写SDP的视频段，重复执行结果不变
+func mungeSDP(sdp string, opts SDPMungeOptions) string {
+	if opts.VideoBitrateKbps <= 0 && len(opts.PreferredCodecs) == 0 {
+		return sdp
+	}
+
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\r\n")
+	var out []string
+	for start := 0; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], "m=") {
+			end++
+		}
+		section := lines[start:end]
+		if strings.HasPrefix(section[0], "m=video ") {
+			section = mungeVideoSection(section, opts)
+		}
+		out = append(out, section...)
+		start = end
+	}
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+// mungeVideoSection 调整视频段的编码顺序并设置码率
+func mungeVideoSection(section []string, opts SDPMungeOptions) []string {
+	fields := strings.Fields(section[0])
+	if len(fields) < 4 {
+		return section
+	}
+
+	// 收集payload type对应的编码名和RTX关联
+	codecs := make(map[string]string)
+	rtxOf := make(map[string]string)
+	for _, line := range section[1:] {
+		if rest, ok := strings.CutPrefix(line, "a=rtpmap:"); ok {
+			if pt, encoding, ok := strings.Cut(rest, " "); ok {
+				name, _, _ := strings.Cut(encoding, "/")
+				codecs[pt] = strings.ToUpper(name)
+			}
+		} else if rest, ok := strings.CutPrefix(line, "a=fmtp:"); ok {
+			if pt, params, ok := strings.Cut(rest, " "); ok {
+				for _, param := range strings.Split(params, ";") {
+					if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && key == "apt" {
+						rtxOf[pt] = value
+					}
+				}
+			}
+		}
+	}
+
+	payloadTypes := fields[3:]
+	var preferred []string
+	isPreferred := make(map[string]bool)
+	for _, codec := range opts.PreferredCodecs {
+		for _, pt := range payloadTypes {
+			if codecs[pt] == strings.ToUpper(codec) && !isPreferred[pt] {
+				preferred = append(preferred, pt)
+				isPreferred[pt] = true
+			}
+		}
+	}
+
+	// 没有匹配的首选编码时不移除任何编码，避免视频段为空
+	removed := make(map[string]bool)
+	ordered := append([]string{}, preferred...)
+	for _, pt := range payloadTypes {
+		if isPreferred[pt] {
+			continue
+		}
+		if opts.RemoveOtherCodecs && len(preferred) > 0 && !isPreferred[rtxOf[pt]] {
+			removed[pt] = true
+			continue
+		}
+		ordered = append(ordered, pt)
+	}
+
+	result := []string{strings.Join(append(fields[:3:3], ordered...), " ")}
+	for _, line := range section[1:] {
+		if strings.HasPrefix(line, "b=AS:") || removed[sdpAttributePayloadType(line)] {
+			continue
+		}
+		result = append(result, line)
+	}
+
+	// b=AS需位于c=之后、a=之前
+	if opts.VideoBitrateKbps > 0 {
+		bandwidth := fmt.Sprintf("b=AS:%d", opts.VideoBitrateKbps)
+		insertAt := 1
+		for i, line := range result {
+			if strings.HasPrefix(line, "c=") {
+				insertAt = i + 1
+				break
+			}
+		}
+		result = append(result[:insertAt], append([]string{bandwidth}, result[insertAt:]...)...)
+	}
+	return result
+}
+
+// sdpAttributePayloadType 返回rtpmap/fmtp/rtcp-fb属性行的payload type
+func sdpAttributePayloadType(line string) string {
+	for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			pt, _, _ := strings.Cut(rest, " ")
+			return pt
+		}
+	}
+	return ""
+}
+
+func generate_id() int {
+	return int(
+		time.Now().UnixMilli() % 2147483648,
+	)
+}
+
+// buildCommandParameter 生成命令的parameter字段
+// data为nil时沿用命令ID，否则序列化为JSON并按sportCmdParams校验必填字段
+func buildCommandParameter(cmd SportCommand, data interface{}) (string, error) {
+	command := cmd.Name()
+	fields, needParams := sportCmdParams[command]
+	if data == nil {
+		if needParams {
+			return "", fmt.Errorf("命令 %s 缺少参数: %s", command, strings.Join(fields, ", "))
+		}
+		return strconv.Itoa(cmd.ID()), nil
+	}
+
+	paramJSON, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("序列化命令参数失败: %v", err)
+	}
+
+	if needParams {
+		var params map[string]interface{}
+		if err := json.Unmarshal(paramJSON, &params); err != nil || params == nil {
+			return "", fmt.Errorf("命令 %s 的参数必须是对象", command)
+		}
+		for _, field := range fields {
+			if _, exists := params[field]; !exists {
+				return "", fmt.Errorf("命令 %s 缺少参数字段: %s", command, field)
+			}
+		}
+	}
+
+	return string(paramJSON), nil
+}
 
-	// ECB模式解密
-	for i := 0; i < len(encryptedBytes); i += aes.BlockSize {
-		block.Decrypt(decrypted[i:i+aes.BlockSize], encryptedBytes[i:i+aes.BlockSize])
-	}
+// {"type": "msg", "topic": "rt/api/sport/request", "data": {"header": {"identity": {"id": 1626023453, "api_id": 1005}}, "parameter": "1005"}}
+// {"type": "msg", "topic": "rt/api/sport/request"," data": {"header": {"identity": {"api_id": 1004, "id": 1626306583}}, "parameter": "1004"}}
+// {"type": "msg", "topic": "rt/api/sport/request", "data": {"header": {"identity": {"id": 1626306583, "api_id": 1008}}, "parameter": "{\"x\":0.3,\"y\":0,\"z\":0}"}}
+// SendCommand 发送机器人命令
+func (conn *Go2Connection) SendCommand(command string, data interface{}) error {
+	return conn.sendCommand(command, data, conn.nextRequestID())
+}
 
-	unpadded := unpad(decrypted)
-	return string(unpadded)
+// sendCommand 以指定的请求id发送机器人命令
+func (conn *Go2Connection) sendCommand(command string, data interface{}, requestID int) error {
+	return conn.sendCommandGuarded(command, data, requestID, nil)
 }
 
-// rsaLoadPublicKey 加载RSA公钥
-func rsaLoadPublicKey(pemData string) (*rsa.PublicKey, error) {
-	keyBytes, err := base64.StdEncoding.DecodeString(pemData)
-	if err != nil {
-		return nil, err
+// sendCommandGuarded 同sendCommand，guard见publishGuarded
+func (conn *Go2Connection) sendCommandGuarded(command string, data interface{}, requestID int, guard func(send func() error) error) (err error) {
+	defer func() { conn.recordCommand(command, data, requestID, err) }()
+
+	cmd, exists := LookupCommand(command)
+	if !exists {
+		return fmt.Errorf("未知命令: %s", command)
 	}
 
-	publicKey, err := x509.ParsePKIXPublicKey(keyBytes)
+	parameter, err := buildCommandParameter(cmd, data)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
-		return rsaKey, nil
+	// 紧急命令先停止摇杆循环，且不等待发送缓冲
+	urgent := conn.isEmergencyCommand(command)
+	if urgent {
+		conn.stopJoystickLoop()
 	}
-	return nil, fmt.Errorf("不是RSA公钥")
-}
 
-// rsaEncrypt RSA加密
-func rsaEncrypt(data string, publicKey *rsa.PublicKey) string {
-	dataBytes := []byte(data)
-	maxChunkSize := publicKey.Size() - 11
-	var encryptedBytes []byte
+	return conn.publishGuarded(conn.commandTopic(command), map[string]interface{}{
+		"header":    map[string]interface{}{"identity": map[string]interface{}{"id": requestID, "api_id": cmd.ID()}},
+		"parameter": parameter,
+	}, MessageType, urgent, guard)
+}
 
-	for i := 0; i < len(dataBytes); i += maxChunkSize {
-		end := i + maxChunkSize
-		if end > len(dataBytes) {
-			end = len(dataBytes)
+// SetEmergencyCommands 设置紧急命令，默认为Damp和StopMove
+func (conn *Go2Connection) SetEmergencyCommands(commands []string) error {
+	emergency := make(map[string]bool, len(commands))
+	for _, command := range commands {
+		if _, exists := LookupCommand(command); !exists {
+			return fmt.Errorf("未知命令: %s", command)
 		}
-		chunk := dataBytes[i:end]
+		emergency[command] = true
+	}
 
-		encryptedChunk, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, chunk)
-		if err != nil {
-			log.Printf("RSA加密失败: %v", err)
-			return ""
+	conn.emergencyMu.Lock()
+	conn.emergencyCommands = emergency
+	conn.emergencyMu.Unlock()
+	return nil
+}
+
+// SetCommandTopics 设置命令发布的话题，未设置的命令发布到SportRequestTopic
+func (conn *Go2Connection) SetCommandTopics(topics map[string]string) error {
+	commandTopics := make(map[string]string, len(topics))
+	for command, topic := range topics {
+		if _, exists := LookupCommand(command); !exists {
+			return fmt.Errorf("未知命令: %s", command)
 		}
-		encryptedBytes = append(encryptedBytes, encryptedChunk...)
+		if topic == "" {
+			return fmt.Errorf("命令 %s 的话题不能为空", command)
+		}
+		commandTopics[command] = topic
 	}
 
-	return base64.StdEncoding.EncodeToString(encryptedBytes)
+	conn.commandTopicsMu.Lock()
+	conn.commandTopics = commandTopics
+	conn.commandTopicsMu.Unlock()
+	return nil
 }
 
-// calcLocalPathEnding 计算本地路径结尾
-func calcLocalPathEnding(data1 string) string {
-	strArr := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J"}
+// commandTopic 返回命令发布的话题
+func (conn *Go2Connection) commandTopic(command string) string {
+	conn.commandTopicsMu.Lock()
+	defer conn.commandTopicsMu.Unlock()
+	if topic, exists := conn.commandTopics[command]; exists {
+		return topic
+	}
+	return SportRequestTopic
+}
 
-	if len(data1) < 10 {
-		return ""
+// isEmergencyCommand 判断是否为紧急命令
+func (conn *Go2Connection) isEmergencyCommand(command string) bool {
+	conn.emergencyMu.Lock()
+	defer conn.emergencyMu.Unlock()
+	return conn.emergencyCommands[command]
+}
+
+// Move 按速度移动，超出安全范围的速度会被拒绝
+// {"type": "msg", "topic": "rt/api/sport/request", "data": {"header": {"identity": {"id": 1626306583, "api_id": 1008}}, "parameter": "{\"x\":0.3,\"y\":0,\"z\":0}"}}
+func (conn *Go2Connection) Move(x, y, z float64) error {
+	params := MoveParams{X: x, Y: y, Z: z}
+	if err := params.Validate(); err != nil {
+		err = fmt.Errorf("Move参数无效: %v", err)
+		conn.recordCommand("Move", params, 0, err)
+		return err
 	}
+	return conn.SendCommand("Move", params)
+}
 
-	last10Chars := data1[len(data1)-10:]
-	var arrayList []int
+// SendCommandAck 发送命令并等待机器人确认，超时未确认时以相同请求id重发
+// 重发次数由SetCommandAckRetries设置，确认中的非0状态码作为错误返回
+func (conn *Go2Connection) SendCommandAck(command string, data interface{}, timeout time.Duration) error {
+	response := make(chan Message, 1)
+	requestID := conn.addPendingRequest(response)
+	defer conn.removePendingRequest(requestID)
+
+	attempts := int(conn.commandAckRetries.Load()) + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := conn.sendCommand(command, data, requestID); err != nil {
+			return err
+		}
 
-	for i := 0; i < len(last10Chars); i += 2 {
-		if i+1 < len(last10Chars) {
-			secondChar := string(last10Chars[i+1])
-			for j, str := range strArr {
-				if str == secondChar {
-					arrayList = append(arrayList, j)
-					break
-				}
-			}
+		select {
+		case message := <-response:
+			_, err := decodeResponseData(message)
+			return err
+		case <-time.After(timeout):
+			conn.getLogger().Warnf("命令 %s 第%d次发送未确认(%v)", command, attempt, timeout)
 		}
 	}
+	return fmt.Errorf("%w: %s 发送%d次均超时", ErrCommandNotAcked, command, attempts)
+}
 
-	var result strings.Builder
-	for _, index := range arrayList {
-		result.WriteString(strconv.Itoa(index))
+// SetCommandAckRetries 设置SendCommandAck未收到确认时的重发次数，0表示不重发
+func (conn *Go2Connection) SetCommandAckRetries(retries int) {
+	if retries < 0 {
+		retries = defaultCommandAckRetries
 	}
-
-	return result.String()
+	conn.commandAckRetries.Store(int64(retries))
 }
 
-// makeLocalRequest 发送本地请求
-func makeLocalRequest(path string, body io.Reader, headers map[string]string) (*http.Response, error) {
-	req, err := http.NewRequest("POST", path, body)
-	if err != nil {
+// Query 发送查询命令(如GetState、GetBodyHeight)并等待机器人响应
+// 响应按请求id匹配，返回响应中解码后的data字段
+func (conn *Go2Connection) Query(command string, timeout time.Duration) (interface{}, error) {
+	response := make(chan Message, 1)
+	requestID := conn.addPendingRequest(response)
+	defer conn.removePendingRequest(requestID)
+
+	if err := conn.sendCommand(command, nil, requestID); err != nil {
 		return nil, err
 	}
 
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	select {
+	case message := <-response:
+		return decodeResponseData(message)
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("等待命令 %s 的响应超时(%v)", command, timeout)
 	}
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	return client.Do(req)
+// nextRequestID 分配新的请求id，同一连接内不重复，超过int32范围后从0回绕
+func (conn *Go2Connection) nextRequestID() int {
+	return int(conn.lastRequestID.Add(1) & math.MaxInt32)
 }
 
-// getPeerAnswer 获取对等方应答
-func (conn *Go2Connection) getPeerAnswer(sdpOffer *webrtc.SessionDescription, ip, token string) (map[string]interface{}, error) {
-	sdpOfferJSON := SDPOffer{
-		ID:    "STA_localNetwork",
-		SDP:   sdpOffer.SDP,
-		Type:  sdpOffer.Type.String(),
-		Token: token,
-	}
+// addPendingRequest 分配请求id并登记响应通道
+func (conn *Go2Connection) addPendingRequest(response chan Message) int {
+	requestID := conn.nextRequestID()
 
-	newSDP, err := json.Marshal(sdpOfferJSON)
-	if err != nil {
-		return nil, err
+	conn.pendingMu.Lock()
+	conn.pendingRequests[requestID] = response
+	conn.pendingMu.Unlock()
+	return requestID
+}
+
+// removePendingRequest 注销请求id
+func (conn *Go2Connection) removePendingRequest(requestID int) {
+	conn.pendingMu.Lock()
+	delete(conn.pendingRequests, requestID)
+	conn.pendingMu.Unlock()
+}
+
+// dispatchResponse 将带有请求id的消息交给等待中的请求，返回是否匹配
+func (conn *Go2Connection) dispatchResponse(message Message) bool {
+	requestID, ok := messageRequestID(message)
+	if !ok {
+		return false
 	}
 
-	url := fmt.Sprintf("http://%s:9991/con_notify", ip)
-	resp, err := makeLocalRequest(url, nil, nil)
-	if err != nil {
-		return nil, err
+	conn.pendingMu.Lock()
+	response, exists := conn.pendingRequests[requestID]
+	conn.pendingMu.Unlock()
+	if !exists {
+		return false
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("请求失败，状态码: %d", resp.StatusCode)
+	select {
+	case response <- message:
+	default:
 	}
+	return true
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// messageRequestID 读取消息data.header.identity.id
+func messageRequestID(message Message) (int, bool) {
+	data, ok := message.Data.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	header, ok := data["header"].(map[string]interface{})
+	if !ok {
+		return 0, false
 	}
+	identity, ok := header["identity"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	id, ok := identity["id"].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int(id), true
+}
 
-	// 解码Base64响应
-	decodedResponse, err := base64.StdEncoding.DecodeString(string(body))
-	if err != nil {
-		return nil, err
+// decodeResponseData 检查响应状态码并解码data字段，data为JSON字符串时解析后返回
+func decodeResponseData(message Message) (interface{}, error) {
+	data, _ := message.Data.(map[string]interface{})
+	if header, ok := data["header"].(map[string]interface{}); ok {
+		if status, ok := header["status"].(map[string]interface{}); ok {
+			if code, ok := status["code"].(float64); ok && code != 0 {
+				return nil, fmt.Errorf("命令执行失败，状态码: %d", int(code))
+			}
+		}
 	}
 
-	var decodedJSON map[string]interface{}
-	if err := json.Unmarshal(decodedResponse, &decodedJSON); err != nil {
-		return nil, err
+	payload := data["data"]
+	if text, ok := payload.(string); ok {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(text), &decoded); err == nil {
+			return decoded, nil
+		}
 	}
+	return payload, nil
+}
 
-	log.Printf("getPeerAnswer I newSDP: %s", string(newSDP))
-	log.Printf("getPeerAnswer I url: %s", url)
-	log.Printf("getPeerAnswer I resp: %s", decodedJSON)
+// recordEvent 记录连接事件，超过maxConnectionEvents时覆盖最旧的事件
+func (conn *Go2Connection) recordEvent(eventType, detail string) {
+	event := ConnectionEvent{Time: time.Now(), Type: eventType, Detail: detail}
 
-	data1, ok := decodedJSON["data1"].(string)
-	if !ok {
-		return nil, fmt.Errorf("data1字段不存在")
+	conn.eventsMu.Lock()
+	defer conn.eventsMu.Unlock()
+	if len(conn.events) < maxConnectionEvents {
+		conn.events = append(conn.events, event)
+	} else {
+		conn.events[conn.eventsNext] = event
 	}
+	conn.eventsNext = (conn.eventsNext + 1) % maxConnectionEvents
+}
 
-	// 提取公钥
-	publicKeyPEM := data1[10 : len(data1)-10]
-	pathEnding := calcLocalPathEnding(data1)
+// Events 按时间顺序返回最近的连接事件
+func (conn *Go2Connection) Events() []ConnectionEvent {
+	conn.eventsMu.Lock()
+	defer conn.eventsMu.Unlock()
 
-	// 生成AES密钥
-	aesKey := generateAESKey()
+	if len(conn.events) < maxConnectionEvents {
+		return append([]ConnectionEvent(nil), conn.events...)
+	}
+	events := make([]ConnectionEvent, 0, maxConnectionEvents)
+	events = append(events, conn.events[conn.eventsNext:]...)
+	return append(events, conn.events[:conn.eventsNext]...)
+}
 
-	// 加载公钥
-	publicKey, err := rsaLoadPublicKey(publicKeyPEM)
+// recordCommand 记录命令，err非nil表示命令被拒绝，超过maxCommandHistory时覆盖最旧的记录
+func (conn *Go2Connection) recordCommand(command string, data interface{}, requestID int, err error) {
+	record := CommandRecord{Time: time.Now(), Command: command, Data: data, RequestID: requestID}
 	if err != nil {
-		return nil, err
+		record.Rejected = true
+		record.Error = err.Error()
 	}
 
-	// 加密SDP和AES密钥
-	bodyData := map[string]string{
-		"data1": aesEncrypt(string(newSDP), aesKey),
-		"data2": rsaEncrypt(aesKey, publicKey),
+	conn.commandMu.Lock()
+	defer conn.commandMu.Unlock()
+	if len(conn.commandHistory) < maxCommandHistory {
+		conn.commandHistory = append(conn.commandHistory, record)
+	} else {
+		conn.commandHistory[conn.commandNext] = record
 	}
+	conn.commandNext = (conn.commandNext + 1) % maxCommandHistory
+}
 
-	bodyJSON, err := json.Marshal(bodyData)
-	if err != nil {
-		return nil, err
+// CommandHistory 按时间顺序返回最近发送或被拒绝的命令
+func (conn *Go2Connection) CommandHistory() []CommandRecord {
+	conn.commandMu.Lock()
+	defer conn.commandMu.Unlock()
+
+	if len(conn.commandHistory) < maxCommandHistory {
+		return append([]CommandRecord(nil), conn.commandHistory...)
 	}
+	history := make([]CommandRecord, 0, maxCommandHistory)
+	history = append(history, conn.commandHistory[conn.commandNext:]...)
+	return append(history, conn.commandHistory[:conn.commandNext]...)
+}
 
-	// 第二个请求的URL
-	url2 := fmt.Sprintf("http://%s:9991/con_ing_%s", ip, pathEnding)
+// ConnectTimings 返回最近一次连接的各阶段耗时
+func (conn *Go2Connection) ConnectTimings() ConnectTimings {
+	conn.connectTimingsMu.Lock()
+	defer conn.connectTimingsMu.Unlock()
+	return conn.connectTimings
+}
 
-	headers := map[string]string{
-		"Content-Type": "application/x-www-form-urlencoded",
+// State 返回连接当前所处的阶段
+func (conn *Go2Connection) State() RobotConnState {
+	if conn.getValidationResult() == "FAILED" {
+		return RobotConnFailed
 	}
 
-	// 使用字符串形式的body，与Python版本一致
-	resp, err = makeLocalRequest(url2, strings.NewReader(string(bodyJSON)), headers)
-	if err != nil {
-		return nil, err
+	peerState := conn.peerConnection.ConnectionState()
+	switch {
+	case peerState == webrtc.PeerConnectionStateFailed:
+		return RobotConnFailed
+	case conn.IsReady():
+		return RobotConnReady
+	case conn.dataChannel.ReadyState() == webrtc.DataChannelStateOpen:
+		return RobotConnValidating
+	case conn.connecting.Load() || peerState == webrtc.PeerConnectionStateConnecting:
+		return RobotConnConnecting
+	default:
+		return RobotConnDisconnected
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("加密请求失败，状态码: %d", resp.StatusCode)
+// WaitForReady 阻塞直到验证成功且数据通道已打开
+// 验证重试耗尽时返回ErrValidationFailed，ctx取消时返回ctx的错误
+func (conn *Go2Connection) WaitForReady(ctx context.Context) error {
+	select {
+	case <-conn.validationDone:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	body, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if conn.getValidationResult() != "SUCCESS" {
+		return ErrValidationFailed
 	}
+	if !conn.IsReady() {
+		return fmt.Errorf("数据通道已关闭")
+	}
+	return nil
+}
 
-	// 解密响应
-	decryptedResponse := aesDecrypt(string(body), aesKey)
+// IsReady 验证成功且数据通道已打开时返回true
+func (conn *Go2Connection) IsReady() bool {
+	return conn.getValidationResult() == "SUCCESS" &&
+		conn.dataChannel != nil &&
+		conn.dataChannel.ReadyState() == webrtc.DataChannelStateOpen
+}
 
-	var peerAnswer map[string]interface{}
-	if err := json.Unmarshal([]byte(decryptedResponse), &peerAnswer); err != nil {
-		return nil, err
+// SetLogger 设置连接使用的日志，nil恢复默认日志
+func (conn *Go2Connection) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = defaultLogger
 	}
+	conn.logger.Store(&logger)
+}
 
-	log.Printf("getPeerAnswer II url2: %s", url2)
-	log.Printf("getPeerAnswer II headers: %s", headers)
-	log.Printf("getPeerAnswer II resp.body: %s", string(decryptedResponse))
-	log.Printf("getPeerAnswer II peerAnswer: %s", peerAnswer)
-
-	return peerAnswer, nil
+// getLogger 返回当前日志，SetLogger可在连接运行中调用
+func (conn *Go2Connection) getLogger() Logger {
+	return *conn.logger.Load()
 }
 
-// ConnectRobot 连接到机器人
-func (conn *Go2Connection) ConnectRobot() error {
-	// 创建提议
-	offer, err := conn.peerConnection.CreateOffer(nil)
-	if err != nil {
-		return fmt.Errorf("创建提议失败: %v", err)
+// SetHeartbeatInterval 设置心跳间隔，需在连接前调用
+func (conn *Go2Connection) SetHeartbeatInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
 	}
+	conn.heartbeatMu.Lock()
+	conn.heartbeatInterval = interval
+	conn.heartbeatMu.Unlock()
+}
 
-	// 设置本地描述
-	err = conn.peerConnection.SetLocalDescription(offer)
-	if err != nil {
-		return fmt.Errorf("设置本地描述失败: %v", err)
+// SetConnectionTimeout 设置连接超时时间(握手、ICE连接到数据通道打开的总时长)，需在连接前调用
+func (conn *Go2Connection) SetConnectionTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultConnectionTimeout
 	}
+	conn.settingsMu.Lock()
+	conn.connectionTimeout = timeout
+	conn.settingsMu.Unlock()
+}
 
-	sdp_offer := conn.peerConnection.LocalDescription()
-	log.Printf("ConnectRobot I sdp_offer: %v", sdp_offer)
-
-	// 获取对等方应答
-	peerAnswer, err := conn.getPeerAnswer(sdp_offer, conn.ip, conn.token)
-	if err != nil {
-		return fmt.Errorf("获取对等方应答失败: %v", err)
+// SetRobotSignalingPort 设置机器人信令HTTP接口端口，默认9991
+func (conn *Go2Connection) SetRobotSignalingPort(port int) {
+	if port <= 0 || port > 65535 {
+		port = defaultRobotSignalingPort
 	}
+	conn.settingsMu.Lock()
+	conn.signalingPort = port
+	conn.settingsMu.Unlock()
+}
 
-	// 设置远程描述
-	sdp, ok := peerAnswer["sdp"].(string)
-	if !ok {
-		return fmt.Errorf("应答中缺少SDP")
+// SetRobotHTTPTimeout 设置单次信令HTTP请求的超时时间，默认10秒
+func (conn *Go2Connection) SetRobotHTTPTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultRobotHTTPTimeout
 	}
+	conn.settingsMu.Lock()
+	conn.httpTimeout = timeout
+	conn.settingsMu.Unlock()
+}
 
-	answer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  sdp,
-	}
+// SetSDPMunge 设置发送给机器人的提议SDP改写选项，需在连接前调用
+func (conn *Go2Connection) SetSDPMunge(opts SDPMungeOptions) {
+	conn.settingsMu.Lock()
+	conn.sdpMunge = opts
+	conn.settingsMu.Unlock()
+}
 
-	err = conn.peerConnection.SetRemoteDescription(answer)
-	if err != nil {
-		return fmt.Errorf("设置远程描述失败: %v", err)
+// SetMaxBufferedAmount 设置数据通道发送缓冲上限(字节)，超过时触发背压处理
+func (conn *Go2Connection) SetMaxBufferedAmount(limit uint64) {
+	if limit == 0 {
+		limit = defaultMaxBufferedAmount
 	}
+	conn.maxBufferedAmount.Store(limit)
+	conn.dataChannel.SetBufferedAmountLowThreshold(lowThreshold(limit))
+}
 
-	log.Println("成功连接到机器人")
-	return nil
+// SetMaxMessageSize 设置接收消息大小上限(字节)，超过的消息不解析直接丢弃
+// 超过65535字节的消息在pion中会关闭数据通道，设置更大的上限没有作用
+func (conn *Go2Connection) SetMaxMessageSize(limit int) {
+	if limit <= 0 {
+		limit = defaultMaxMessageSize
+	}
+	conn.maxMessageSize.Store(int64(limit))
 }
 
-func generate_id() int {
-	return int(
-		time.Now().UnixMilli() % 2147483648,
-	)
+// SetCallbackPool 设置执行消息回调的工作协程数和队列长度，需在连接前调用
+// 多于一个工作协程时回调可能乱序执行
+func (conn *Go2Connection) SetCallbackPool(workers, queueSize int) {
+	if workers <= 0 {
+		workers = defaultCallbackWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultCallbackQueueSize
+	}
+	conn.settingsMu.Lock()
+	conn.callbackWorkers = workers
+	conn.callbackQueueSize = queueSize
+	conn.settingsMu.Unlock()
 }
 
-// {"type": "msg", "topic": "rt/api/sport/request", "data": {"header": {"identity": {"id": 1626023453, "api_id": 1005}}, "parameter": "1005"}}
-// {"type": "msg", "topic": "rt/api/sport/request"," data": {"header": {"identity": {"api_id": 1004, "id": 1626306583}}, "parameter": "1004"}}
-// SendCommand 发送机器人命令
-func (conn *Go2Connection) SendCommand(command string, data interface{}) {
-	if cmdID, exists := SportCmd[command]; exists {
-		conn.publish("rt/api/sport/request", map[string]interface{}{
-			"header":    map[string]interface{}{"identity": map[string]interface{}{"id": generate_id(), "api_id": cmdID}},
-			"parameter": strconv.Itoa(cmdID),
-		}, MessageType)
-	} else {
-		log.Printf("未知命令: %s", command)
+// SetHandshakeCipher 设置握手时SDP的AES加密模式，默认ECB以兼容旧固件
+func (conn *Go2Connection) SetHandshakeCipher(mode string) error {
+	switch mode {
+	case HandshakeCipherECB, HandshakeCipherCBC:
+		conn.settingsMu.Lock()
+		conn.handshakeCipher = mode
+		conn.settingsMu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("不支持的加密模式: %s", mode)
 	}
 }
 
-// startHeartbeat 启动心跳
+// startHeartbeat 启动心跳，数据通道打开和验证成功都会调用，已启动时不重复启动
 func (conn *Go2Connection) startHeartbeat() {
-	log.Println("启动心跳机制")
-	// conn.sendHeartbeat()
+	conn.heartbeatMu.Lock()
+	defer conn.heartbeatMu.Unlock()
+
+	if conn.heartbeatTimer != nil {
+		return
+	}
+	conn.getLogger().Infof("启动心跳机制")
+	conn.heartbeatTimer = time.AfterFunc(0, conn.sendHeartbeat)
 }
 
 // sendHeartbeat 发送心跳
@@ -650,22 +2418,132 @@ func (conn *Go2Connection) sendHeartbeat() {
 		conn.publish("", data, HeartbeatType)
 	}
 
-	// 2秒后发送下一次心跳
-	conn.heartbeatTimer = time.AfterFunc(2*time.Second, conn.sendHeartbeat)
+	// 间隔heartbeatInterval后发送下一次心跳，已停止则不再调度
+	conn.heartbeatMu.Lock()
+	defer conn.heartbeatMu.Unlock()
+	if conn.heartbeatTimer != nil {
+		conn.heartbeatTimer.Reset(conn.heartbeatInterval)
+	}
 }
 
 // stopHeartbeat 停止心跳
 func (conn *Go2Connection) stopHeartbeat() {
+	conn.heartbeatMu.Lock()
+	defer conn.heartbeatMu.Unlock()
 	if conn.heartbeatTimer != nil {
 		conn.heartbeatTimer.Stop()
 		conn.heartbeatTimer = nil
 	}
 }
 
+// SetJoystickDeadman 设置摇杆死人开关时间，超过该时间未更新速度则自动停止
+func (conn *Go2Connection) SetJoystickDeadman(window time.Duration) {
+	if window <= 0 {
+		window = defaultJoystickDeadman
+	}
+	conn.joystickMu.Lock()
+	conn.joystickDeadman = window
+	conn.joystickMu.Unlock()
+}
+
+// Joystick 以摇杆方式持续移动，x/y为前后/左右速度，yaw为转向速度
+// 调用后按固定频率重复发送Move，超过死人开关时间未再调用则发送StopMove
+func (conn *Go2Connection) Joystick(x, y, yaw float64) error {
+	params := MoveParams{X: x, Y: y, Z: yaw}
+	if err := params.Validate(); err != nil {
+		err = fmt.Errorf("摇杆速度无效: %v", err)
+		conn.recordCommand("Move", params, 0, err)
+		return err
+	}
+
+	conn.joystickMu.Lock()
+	conn.joystickParams = params
+	conn.joystickUpdated = time.Now()
+	if conn.joystickStop == nil {
+		conn.joystickStop = make(chan struct{})
+		go conn.runJoystick(conn.joystickStop)
+	}
+	stop := conn.joystickStop
+	conn.joystickMu.Unlock()
+
+	return conn.sendJoystickMove(stop, params)
+}
+
+// sendJoystickMove 发送摇杆循环stop的Move
+// 等待发送缓冲后在joystickMu下确认循环未被停止才发送；紧急命令发送前先经stopJoystickLoop取得joystickMu，
+// 因此Move要么在紧急命令之前发出，要么不再发送
+func (conn *Go2Connection) sendJoystickMove(stop chan struct{}, params MoveParams) error {
+	return conn.sendCommandGuarded("Move", params, conn.nextRequestID(), func(send func() error) error {
+		conn.joystickMu.Lock()
+		defer conn.joystickMu.Unlock()
+		if conn.joystickStop != stop {
+			return errJoystickStopped
+		}
+		return send()
+	})
+}
+
+// StopJoystick 退出摇杆模式并让机器人停止移动
+func (conn *Go2Connection) StopJoystick() error {
+	conn.stopJoystickLoop()
+	return conn.SendCommand("StopMove", nil)
+}
+
+// runJoystick 摇杆循环，重复发送最近的速度直到停止或死人开关触发
+func (conn *Go2Connection) runJoystick(stop chan struct{}) {
+	ticker := time.NewTicker(joystickSendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		conn.joystickMu.Lock()
+		if conn.joystickStop != stop {
+			// 循环已被停止或替换
+			conn.joystickMu.Unlock()
+			return
+		}
+		deadman := conn.joystickDeadman
+		if time.Since(conn.joystickUpdated) > deadman {
+			conn.joystickStop = nil
+			conn.joystickMu.Unlock()
+			conn.getLogger().Warnf("摇杆超过%v未更新，停止移动", deadman)
+			if err := conn.SendCommand("StopMove", nil); err != nil {
+				conn.getLogger().Errorf("发送StopMove失败: %v", err)
+			}
+			return
+		}
+		params := conn.joystickParams
+		conn.joystickMu.Unlock()
+
+		if err := conn.sendJoystickMove(stop, params); errors.Is(err, errJoystickStopped) {
+			return
+		} else if err != nil {
+			conn.getLogger().Warnf("摇杆发送Move失败: %v", err)
+		}
+	}
+}
+
+// stopJoystickLoop 停止摇杆循环
+func (conn *Go2Connection) stopJoystickLoop() {
+	conn.joystickMu.Lock()
+	defer conn.joystickMu.Unlock()
+	if conn.joystickStop != nil {
+		close(conn.joystickStop)
+		conn.joystickStop = nil
+	}
+}
+
 // Close 关闭连接
 func (conn *Go2Connection) Close() error {
-	// 停止心跳
+	// 停止心跳、摇杆和回调工作协程
 	conn.stopHeartbeat()
+	conn.stopJoystickLoop()
+	conn.closeOnce.Do(func() { close(conn.closed) })
 
 	if conn.peerConnection != nil {
 		return conn.peerConnection.Close()
@@ -673,12 +2551,26 @@ func (conn *Go2Connection) Close() error {
 	return nil
 }
 
-// 示例使用
+// getEnv 读取环境变量，未设置时返回默认值
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
+
+// 示例使用，环境变量GO2_IP、GO2_TOKEN、GO2_LOG_LEVEL优先于默认值
 func main() {
+	ip := getEnv("GO2_IP", "192.168.123.161")
+	token := getEnv("GO2_TOKEN", "")
+
+	level, err := ParseLogLevel(getEnv("GO2_LOG_LEVEL", "info"))
+	if err != nil {
+		log.Fatal("日志级别无效:", err)
+	}
+
 	// 创建连接
-	conn := NewGo2Connection(
-		"192.168.123.161", // 机器人IP
-		"",                // 机器人令牌
+	conn, err := NewGo2Connection(
 		func() {
 			log.Println("验证成功")
 		},
@@ -688,24 +2580,40 @@ func main() {
 		func() {
 			log.Println("连接已打开")
 		},
+		func(packet rtp.Packet) {
+			// log.Printf("收到RTP包: %d", packet.SequenceNumber)
+		},
 	)
+	if err != nil {
+		log.Fatal("创建连接失败:", err)
+	}
+	conn.SetLogger(NewStdLogger(level))
 
 	// 连接到机器人
-	err := conn.ConnectRobot()
+	err = conn.Connect(ip, token)
 	if err != nil {
 		log.Fatal("连接失败:", err)
 	}
 
-	// 等待连接建立
-	time.Sleep(2 * time.Second)
+	// 等待验证完成
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = conn.WaitForReady(ctx)
+	cancel()
+	if err != nil {
+		log.Fatal("等待验证失败:", err)
+	}
 
 	// 发送命令示例
 	// conn.SendCommand("Hello", nil)
 	for i := 0; i < 10; i++ {
 		time.Sleep(10 * time.Second)
-		conn.SendCommand("StandUp", nil)
+		if err := conn.SendCommand("StandUp", nil); err != nil {
+			log.Printf("发送命令失败: %v", err)
+		}
 		time.Sleep(10 * time.Second)
-		conn.SendCommand("StandDown", nil)
+		if err := conn.SendCommand("StandDown", nil); err != nil {
+			log.Printf("发送命令失败: %v", err)
+		}
 	}
 
 	// 保持连接一段时间
@@ -0,0 +1,1839 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/rtcerr"
+)
+
+// testRobot 在本机模拟机器人端的PeerConnection，记录Go2Connection发来的数据通道消息
+type testRobot struct {
+	peerConnection *webrtc.PeerConnection
+	dataChannel    *webrtc.DataChannel
+	respond        func(robot *testRobot, message Message) // 非nil时对每条收到的消息调用
+	videoSender    *webrtc.RTPSender                       // 发送视频时非nil
+
+	mu       sync.Mutex
+	raw      []string
+	received chan Message
+}
+
+// newTestConnection 创建日志静默、禁用mDNS的连接
+func newTestConnection(t *testing.T, opts ConnectionOptions) *Go2Connection {
+	t.Helper()
+	opts.DisableMDNS = true
+	conn, err := NewGo2ConnectionWithOptions(opts, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetLogger(NewStdLogger(LogLevelError))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connectTestRobot 在进程内完成conn与模拟机器人的SDP交换，返回时数据通道已打开
+func connectTestRobot(t *testing.T, conn *Go2Connection, respond func(robot *testRobot, message Message)) *testRobot {
+	t.Helper()
+	return connectTestRobotWithVideo(t, conn, respond, nil)
+}
+
+// connectTestRobotWithVideo 同connectTestRobot，video非nil时机器人通过该轨道向conn发送视频
+func connectTestRobotWithVideo(t *testing.T, conn *Go2Connection, respond func(robot *testRobot, message Message), video webrtc.TrackLocal) *testRobot {
+	t.Helper()
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConnection.Close() })
+
+	robot := &testRobot{peerConnection: peerConnection, respond: respond, received: make(chan Message, 1024)}
+	channelReady := make(chan struct{})
+	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		robot.dataChannel = dc
+		dc.OnOpen(func() { close(channelReady) })
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var message Message
+			if err := json.Unmarshal(msg.Data, &message); err != nil {
+				t.Errorf("机器人收到无效消息: %s", msg.Data)
+				return
+			}
+			robot.mu.Lock()
+			robot.raw = append(robot.raw, string(msg.Data))
+			robot.mu.Unlock()
+			robot.received <- message
+			if robot.respond != nil {
+				robot.respond(robot, message)
+			}
+		})
+	})
+
+	offer, err := conn.peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(conn.peerConnection)
+	if err := conn.peerConnection.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := peerConnection.SetRemoteDescription(*conn.peerConnection.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	if video != nil {
+		sender, err := peerConnection.AddTrack(video)
+		if err != nil {
+			t.Fatal(err)
+		}
+		robot.videoSender = sender
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := conn.peerConnection.SetRemoteDescription(*peerConnection.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ready := range []chan struct{}{conn.channelOpen, channelReady} {
+		select {
+		case <-ready:
+		case <-time.After(10 * time.Second):
+			t.Fatal("等待数据通道打开超时")
+		}
+	}
+	return robot
+}
+
+// write 以机器人身份向conn发送消息，可在respond中调用
+func (robot *testRobot) write(message Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return robot.dataChannel.SendText(string(payload))
+}
+
+// send 同write，失败时结束测试
+func (robot *testRobot) send(t *testing.T, message Message) {
+	t.Helper()
+	if err := robot.write(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// validate 以机器人身份通过验证并等待conn就绪
+func (robot *testRobot) validate(t *testing.T, conn *Go2Connection) {
+	t.Helper()
+	robot.send(t, Message{Type: ValidationType, Data: "Validation Ok."})
+	deadline := time.Now().Add(5 * time.Second)
+	for !conn.IsReady() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待验证成功超时")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// next 等待下一条满足match的消息，其余消息被跳过
+func (robot *testRobot) next(t *testing.T, match func(message Message) bool) Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-robot.received:
+			if match(message) {
+				return message
+			}
+		case <-timeout:
+			t.Fatal("等待机器人收到消息超时")
+		}
+	}
+}
+
+// rawMessages 返回机器人收到的原始JSON
+func (robot *testRobot) rawMessages() []string {
+	robot.mu.Lock()
+	defer robot.mu.Unlock()
+	return append([]string(nil), robot.raw...)
+}
+
+func isType(msgType string) func(message Message) bool {
+	return func(message Message) bool { return message.Type == msgType }
+}
+
+func TestStdLoggerLevels(t *testing.T) {
+	var output bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&output)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+
+	logAll := func(logger Logger) {
+		logger.Debugf("d%d", 1)
+		logger.Infof("i%d", 2)
+		logger.Warnf("w%d", 3)
+		logger.Errorf("e%d", 4)
+	}
+	tests := []struct {
+		level LogLevel
+		want  string
+	}{
+		{LogLevelDebug, "[DEBUG] d1\n[INFO] i2\n[WARN] w3\n[ERROR] e4\n"},
+		{LogLevelInfo, "[INFO] i2\n[WARN] w3\n[ERROR] e4\n"},
+		{LogLevelWarn, "[WARN] w3\n[ERROR] e4\n"},
+		{LogLevelError, "[ERROR] e4\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		logAll(NewStdLogger(tt.level))
+		if output.String() != tt.want {
+			t.Errorf("级别%d输出:\n%s期望:\n%s", tt.level, output.String(), tt.want)
+		}
+	}
+
+	for _, name := range []string{"debug", "INFO", "", "warning", "error"} {
+		if _, err := ParseLogLevel(name); err != nil {
+			t.Errorf("ParseLogLevel(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("未知日志级别应返回错误")
+	}
+}
+
+func TestLookupCommand(t *testing.T) {
+	tests := []struct {
+		name              string
+		id                int
+		requiresParameter bool
+	}{
+		{name: "Damp", id: 1001},
+		{name: "StandUp", id: 1004},
+		{name: "Move", id: 1008, requiresParameter: true},
+		{name: "Euler", id: 1007, requiresParameter: true},
+		{name: "BodyHeight", id: 1013, requiresParameter: true},
+	}
+	for _, tt := range tests {
+		cmd, exists := LookupCommand(tt.name)
+		if !exists {
+			t.Errorf("LookupCommand(%q)未找到", tt.name)
+			continue
+		}
+		if cmd.ID() != tt.id || cmd.Name() != tt.name || cmd.String() != tt.name {
+			t.Errorf("%s: ID=%d Name=%q String=%q", tt.name, cmd.ID(), cmd.Name(), cmd.String())
+		}
+		if cmd.RequiresParameter() != tt.requiresParameter {
+			t.Errorf("%s.RequiresParameter() = %v", tt.name, cmd.RequiresParameter())
+		}
+	}
+
+	cmd, exists := LookupCommand("NoSuchCommand")
+	if exists {
+		t.Fatal("未知命令不应被找到")
+	}
+	if cmd.Name() != "" || cmd.RequiresParameter() {
+		t.Errorf("未知命令 Name=%q RequiresParameter=%v", cmd.Name(), cmd.RequiresParameter())
+	}
+	if unknown := SportCommand(9999); unknown.Name() != "" || unknown.String() != "SportCommand(9999)" {
+		t.Errorf("未知ID Name=%q String=%q", unknown.Name(), unknown.String())
+	}
+}
+
+func TestBuildCommandParameter(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		data    interface{}
+		want    string
+		wantErr string
+	}{
+		{name: "无参数命令使用命令ID", command: "StandUp", want: "1004"},
+		{name: "Move", command: "Move", data: MoveParams{X: 0.3, Y: 0, Z: -0.5}, want: `{"x":0.3,"y":0,"z":-0.5}`},
+		{name: "Move使用map", command: "Move", data: map[string]float64{"x": 1, "y": 0.2, "z": 0}, want: `{"x":1,"y":0.2,"z":0}`},
+		{name: "Euler", command: "Euler", data: map[string]float64{"x": 0.1, "y": -0.2, "z": 0}, want: `{"x":0.1,"y":-0.2,"z":0}`},
+		{name: "BodyHeight", command: "BodyHeight", data: map[string]float64{"data": 0.05}, want: `{"data":0.05}`},
+		{name: "Move缺少全部参数", command: "Move", wantErr: "缺少参数: x, y, z"},
+		{name: "Move缺少x", command: "Move", data: map[string]float64{"y": 0, "z": 0}, wantErr: "缺少参数字段: x"},
+		{name: "Move缺少y", command: "Move", data: map[string]float64{"x": 0, "z": 0}, wantErr: "缺少参数字段: y"},
+		{name: "Move缺少z", command: "Move", data: map[string]float64{"x": 0, "y": 0}, wantErr: "缺少参数字段: z"},
+		{name: "Move参数不是对象", command: "Move", data: []float64{0, 0, 0}, wantErr: "参数必须是对象"},
+		{name: "BodyHeight缺少data", command: "BodyHeight", data: map[string]float64{"height": 0.05}, wantErr: "缺少参数字段: data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, exists := LookupCommand(tt.command)
+			if !exists {
+				t.Fatalf("未知命令: %s", tt.command)
+			}
+
+			got, err := buildCommandParameter(cmd, tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, 期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parameter = %s, 期望 %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectRobotRequiresIP(t *testing.T) {
+	conn, err := NewGo2Connection(nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.ConnectRobot()
+	if err == nil || !strings.Contains(err.Error(), "未设置机器人IP") {
+		t.Fatalf("err = %v, 期望未设置IP的错误", err)
+	}
+	if timings := conn.ConnectTimings(); timings.TotalMs != 0 {
+		t.Errorf("未设置IP时不应开始握手: %+v", timings)
+	}
+}
+
+func TestAESRoundTrip(t *testing.T) {
+	key := generateAESKey()
+	for _, mode := range []string{HandshakeCipherECB, HandshakeCipherCBC} {
+		for _, plaintext := range []string{"", "a", "0123456789abcdef", `{"id":"STA_localNetwork","sdp":"v=0\r\n","type":"offer"}`} {
+			encrypted := aesEncrypt(plaintext, key, mode)
+			if encrypted == "" {
+				t.Fatalf("%s: 加密%q失败", mode, plaintext)
+			}
+			if got := aesDecrypt(encrypted, key, mode); got != plaintext {
+				t.Errorf("%s: 解密结果 %q, 期望 %q", mode, got, plaintext)
+			}
+		}
+	}
+}
+
+func TestAESCBCUsesRandomIV(t *testing.T) {
+	key := generateAESKey()
+	first := aesEncrypt("same plaintext", key, HandshakeCipherCBC)
+	second := aesEncrypt("same plaintext", key, HandshakeCipherCBC)
+	if first == second {
+		t.Fatal("CBC模式相同明文的密文不应相同")
+	}
+
+	// ECB模式没有IV，相同明文得到相同密文
+	if aesEncrypt("same plaintext", key, HandshakeCipherECB) != aesEncrypt("same plaintext", key, HandshakeCipherECB) {
+		t.Fatal("ECB模式相同明文的密文应相同")
+	}
+}
+
+func TestAESDecryptRejectsPartialBlocks(t *testing.T) {
+	key := generateAESKey()
+	for _, mode := range []string{HandshakeCipherECB, HandshakeCipherCBC} {
+		for _, length := range []int{1, 15, 17, 33} {
+			encrypted := base64.StdEncoding.EncodeToString(make([]byte, length))
+			if got := aesDecrypt(encrypted, key, mode); got != "" {
+				t.Errorf("%s: %d字节密文应被拒绝，得到 %q", mode, length, got)
+			}
+		}
+	}
+
+	// CBC密文至少包含IV和一个数据块
+	if got := aesDecrypt(base64.StdEncoding.EncodeToString(make([]byte, 16)), key, HandshakeCipherCBC); got != "" {
+		t.Errorf("只有IV的CBC密文应被拒绝，得到 %q", got)
+	}
+}
+
+func TestWaitForReadyTimesOutWhilePending(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	connectTestRobot(t, conn, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := conn.WaitForReady(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("验证未完成时应超时，err = %v", err)
+	}
+}
+
+func TestWaitForReadyReturnsAfterValidation(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+
+	done := make(chan error, 1)
+	go func() { done <- conn.WaitForReady(context.Background()) }()
+
+	robot.send(t, Message{Type: ValidationType, Data: "Validation Ok."})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("验证成功后err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("验证成功后WaitForReady未返回")
+	}
+}
+
+func TestWaitForReadyFailsAfterValidationRetries(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	conn.SetValidationRetry(2, time.Millisecond)
+	failed := make(chan error, 1)
+	conn.OnValidationFailed(func(err error) { failed <- err })
+
+	// 机器人拒绝每一次验证数据
+	robot := connectTestRobot(t, conn, func(robot *testRobot, message Message) {
+		if message.Type == ValidationType {
+			robot.write(Message{Type: "err", Data: map[string]interface{}{"info": "Validation Needed."}})
+		}
+	})
+	robot.send(t, Message{Type: ValidationType, Data: "key"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.WaitForReady(ctx); !errors.Is(err, ErrValidationFailed) {
+		t.Fatalf("验证重试耗尽后err = %v, 期望ErrValidationFailed", err)
+	}
+	select {
+	case err := <-failed:
+		if !errors.Is(err, ErrValidationFailed) {
+			t.Fatalf("OnValidationFailed收到的err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("未调用OnValidationFailed")
+	}
+	if conn.IsReady() {
+		t.Fatal("验证失败后IsReady应为false")
+	}
+}
+
+// waitForState 等待conn.State()变为want
+func waitForState(t *testing.T, conn *Go2Connection, want RobotConnState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("State() = %v, 期望 %v", conn.State(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnectionStateLifecycle(t *testing.T) {
+	// 握手进行中为connecting，取消后回到disconnected
+	stalled := newTestConnection(t, ConnectionOptions{})
+	if state := stalled.State(); state != RobotConnDisconnected {
+		t.Fatalf("新建连接State() = %v", state)
+	}
+	newStallingSignalingServer(t, stalled)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- stalled.ConnectContext(ctx, "127.0.0.1", "token") }()
+	waitForState(t, stalled, RobotConnConnecting)
+	cancel()
+	<-done
+	waitForState(t, stalled, RobotConnDisconnected)
+
+	// 数据通道打开后等待验证，验证成功后就绪
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	waitForState(t, conn, RobotConnValidating)
+	robot.validate(t, conn)
+	waitForState(t, conn, RobotConnReady)
+
+	// 验证重试耗尽后失败
+	rejected := newTestConnection(t, ConnectionOptions{})
+	rejected.SetValidationRetry(1, time.Millisecond)
+	robot = connectTestRobot(t, rejected, func(robot *testRobot, message Message) {
+		if message.Type == ValidationType {
+			robot.write(Message{Type: "err", Data: map[string]interface{}{"info": "Validation Needed."}})
+		}
+	})
+	robot.send(t, Message{Type: ValidationType, Data: "key"})
+	waitForState(t, rejected, RobotConnFailed)
+
+	names := map[RobotConnState]string{
+		RobotConnDisconnected: "disconnected",
+		RobotConnConnecting:   "connecting",
+		RobotConnValidating:   "validating",
+		RobotConnReady:        "ready",
+		RobotConnFailed:       "failed",
+	}
+	for state, name := range names {
+		if state.String() != name {
+			t.Errorf("%d.String() = %s, 期望 %s", int(state), state.String(), name)
+		}
+	}
+}
+
+func TestSubscribeEnvelopes(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+
+	// 验证前登记的订阅在验证成功后发送
+	early := make(chan Message, 1)
+	if err := conn.Subscribe("rt/early", func(message Message) { early <- message }); err != nil {
+		t.Fatal(err)
+	}
+	robot.validate(t, conn)
+	if message := robot.next(t, isType(SubscribeType)); message.Topic != "rt/early" {
+		t.Fatalf("订阅话题 = %s, 期望 rt/early", message.Topic)
+	}
+
+	if err := conn.Subscribe("rt/late", func(Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	if message := robot.next(t, isType(SubscribeType)); message.Topic != "rt/late" {
+		t.Fatalf("订阅话题 = %s, 期望 rt/late", message.Topic)
+	}
+
+	if err := conn.Unsubscribe("rt/late"); err != nil {
+		t.Fatal(err)
+	}
+	if message := robot.next(t, isType(UnsubscribeType)); message.Topic != "rt/late" {
+		t.Fatalf("取消订阅话题 = %s, 期望 rt/late", message.Topic)
+	}
+
+	// 订阅和取消订阅消息不带data字段
+	for _, raw := range robot.rawMessages() {
+		if strings.Contains(raw, `"type":"subscribe"`) || strings.Contains(raw, `"type":"unsubscribe"`) {
+			if strings.Contains(raw, `"data"`) {
+				t.Errorf("订阅消息不应包含data: %s", raw)
+			}
+		}
+	}
+
+	// 订阅话题的消息交给handler
+	robot.send(t, Message{Type: MessageType, Topic: "rt/early", Data: map[string]interface{}{"value": 1.0}})
+	select {
+	case message := <-early:
+		if message.Topic != "rt/early" {
+			t.Errorf("handler收到话题 %s", message.Topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler未收到订阅话题的消息")
+	}
+
+	// 快照可用于在新连接上恢复订阅
+	snapshot := conn.Subscriptions()
+	if len(snapshot) != 1 || snapshot["rt/early"] == nil {
+		t.Fatalf("Subscriptions() = %v, 期望只有rt/early", snapshot)
+	}
+}
+
+// newTestSignalingServer 模拟机器人的con_notify/con_ing接口并设置conn的信令端口
+// notify为con_notify返回的原始响应体，answer为con_ing解密后的JSON内容
+func TestTelemetryDecoding(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	type telemetry struct {
+		topic   string
+		payload interface{}
+	}
+	received := make(chan telemetry, 4)
+	conn.OnTelemetry(func(topic string, payload interface{}) { received <- telemetry{topic, payload} })
+
+	samples := []string{
+		`{"type":"msg","topic":"rt/unknown","data":{"x":1}}`,
+		`{"type":"msg","topic":"rt/lf/lowstate","data":{
+			"imu_state":{"rpy":[0.01,-0.02,1.5],"temperature":40},
+			"motor_state":[{"q":0.1,"temperature":35,"lost":0},{"q":-0.7,"temperature":36,"lost":2}],
+			"bms_state":{"soc":87,"current":-1200,"cycle":12,"bq_ntc":[25,26]},
+			"foot_force":[20,21,22,23],"temperature_ntc1":45,"power_v":28.6}}`,
+		`{"type":"msg","topic":"rt/lf/sportmodestate","data":{
+			"mode":1,"progress":0.5,"gait_type":2,"body_height":0.32,
+			"position":[1.0,2.0,0.3],"velocity":[0.4,0,0],"yaw_speed":0.1,
+			"imu_state":{"quaternion":[1,0,0,0]},"foot_force":[1,2,3,4]}}`,
+	}
+	for _, sample := range samples {
+		conn.handleDataChannelMessage(webrtc.DataChannelMessage{IsString: true, Data: []byte(sample)})
+	}
+
+	next := func() telemetry {
+		t.Helper()
+		select {
+		case item := <-received:
+			return item
+		case <-time.After(5 * time.Second):
+			t.Fatal("未收到遥测回调")
+			return telemetry{}
+		}
+	}
+
+	// 未知话题不触发遥测回调，第一条应为lowstate
+	item := next()
+	lowState, ok := item.payload.(*LowState)
+	if item.topic != LowStateTopic || !ok {
+		t.Fatalf("话题 %s 的数据类型为 %T", item.topic, item.payload)
+	}
+	if lowState.IMUState.RPY[2] != 1.5 || lowState.IMUState.Temperature != 40 ||
+		len(lowState.MotorState) != 2 || lowState.MotorState[1].Q != -0.7 || lowState.MotorState[1].Lost != 2 ||
+		lowState.BMSState.SOC != 87 || lowState.BMSState.Current != -1200 || len(lowState.BMSState.BqNTC) != 2 ||
+		lowState.FootForce[3] != 23 || lowState.TemperatureNTC1 != 45 || lowState.PowerV != 28.6 {
+		t.Errorf("LowState解码错误: %+v", lowState)
+	}
+
+	item = next()
+	sportState, ok := item.payload.(*SportModeState)
+	if item.topic != SportModeStateTopic || !ok {
+		t.Fatalf("话题 %s 的数据类型为 %T", item.topic, item.payload)
+	}
+	if sportState.Mode != 1 || sportState.Progress != 0.5 || sportState.GaitType != 2 || sportState.BodyHeight != 0.32 ||
+		sportState.Position[1] != 2.0 || sportState.Velocity[0] != 0.4 || sportState.YawSpeed != 0.1 ||
+		sportState.IMUState.Quaternion[0] != 1 || len(sportState.FootForce) != 4 {
+		t.Errorf("SportModeState解码错误: %+v", sportState)
+	}
+}
+
+func newTestSignalingServer(t *testing.T, conn *Go2Connection, notify func(data1 string) string, answer interface{}) {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// data1由10位前缀、公钥和10位后缀组成，后缀决定con_ing的路径
+	data1 := "0123456789" + base64.StdEncoding.EncodeToString(der) + "xAxBxCxDxE"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/con_notify", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(notify(data1)))
+	})
+	mux.HandleFunc("/con_ing_"+calcLocalPathEnding(data1), func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encryptedKey, _ := base64.StdEncoding.DecodeString(body["data2"])
+		aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encryptedKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, _ := json.Marshal(answer)
+		w.Write([]byte(aesEncrypt(string(payload), string(aesKey), HandshakeCipherECB)))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	conn.SetRobotSignalingPort(port)
+}
+
+// encodeNotify 按con_notify的格式编码响应
+func encodeNotify(fields map[string]interface{}) string {
+	payload, _ := json.Marshal(fields)
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+func TestConnectHandshakeErrors(t *testing.T) {
+	validNotify := func(data1 string) string { return encodeNotify(map[string]interface{}{"data1": data1}) }
+	tests := []struct {
+		name    string
+		notify  func(data1 string) string
+		answer  interface{}
+		wantErr error
+	}{
+		{name: "缺少data1", notify: func(string) string { return encodeNotify(map[string]interface{}{"data2": "x"}) }, wantErr: ErrHandshakeFailed},
+		{name: "data1不是字符串", notify: func(string) string { return encodeNotify(map[string]interface{}{"data1": 42}) }, wantErr: ErrHandshakeFailed},
+		{name: "data1过短", notify: func(string) string { return encodeNotify(map[string]interface{}{"data1": "0123456789abc"}) }, wantErr: ErrHandshakeFailed},
+		{name: "无效Base64", notify: func(string) string { return "%%%not base64%%%" }, wantErr: ErrHandshakeFailed},
+		{name: "不是JSON", notify: func(string) string { return base64.StdEncoding.EncodeToString([]byte("not json")) }, wantErr: ErrHandshakeFailed},
+		{name: "公钥无效", notify: func(string) string {
+			return encodeNotify(map[string]interface{}{"data1": "0123456789garbage-key!0123456789"})
+		}, wantErr: ErrHandshakeFailed},
+		{name: "应答缺少sdp", notify: validNotify, answer: map[string]interface{}{"type": "answer"}, wantErr: ErrSDPFailed},
+		{name: "sdp不是字符串", notify: validNotify, answer: map[string]interface{}{"sdp": 123, "type": "answer"}, wantErr: ErrSDPFailed},
+		{name: "sdp无法解析", notify: validNotify, answer: map[string]interface{}{"sdp": "not an sdp", "type": "answer"}, wantErr: ErrSDPFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newTestConnection(t, ConnectionOptions{})
+			newTestSignalingServer(t, conn, tt.notify, tt.answer)
+
+			err := conn.ConnectContext(context.Background(), "127.0.0.1", "token")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectClosedConnection(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := conn.Connect("127.0.0.1", "token")
+	if !errors.Is(err, ErrOfferFailed) {
+		t.Fatalf("err = %v, 期望 %v", err, ErrOfferFailed)
+	}
+	// 哨兵错误之外仍保留pion返回的原因
+	var stateErr *rtcerr.InvalidStateError
+	if !errors.As(err, &stateErr) || !errors.Is(err, webrtc.ErrConnectionClosed) {
+		t.Fatalf("err = %v, 应包装pion的InvalidStateError", err)
+	}
+}
+
+// newStallingSignalingServer 启动一个收到请求后不响应的信令服务器，直到客户端放弃或测试结束
+func newStallingSignalingServer(t *testing.T, conn *Go2Connection) {
+	t.Helper()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	conn.SetRobotSignalingPort(port)
+}
+
+func TestConnectHandshakeHTTPTimeout(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	newStallingSignalingServer(t, conn)
+	conn.SetRobotHTTPTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	err := conn.ConnectContext(context.Background(), "127.0.0.1", "token")
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("err = %v, 期望 %v", err, ErrHandshakeFailed)
+	}
+	if conn.ConnectTimings().ConNotifyMs != 0 {
+		t.Errorf("超时的con_notify不应记录耗时")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("HTTP超时未生效，耗时 %v", elapsed)
+	}
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	newStallingSignalingServer(t, conn)
+	conn.SetRobotHTTPTimeout(30 * time.Second)
+
+	// 握手卡在con_notify时取消ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := conn.ConnectContext(ctx, "127.0.0.1", "token")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, 期望 %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("取消后未及时返回，耗时 %v", elapsed)
+	}
+}
+
+func TestConnectionTimeout(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	newStallingSignalingServer(t, conn)
+	// 单次HTTP请求超时远大于整体连接超时，由整体超时中止握手
+	conn.SetRobotHTTPTimeout(30 * time.Second)
+	const timeout = 300 * time.Millisecond
+	conn.SetConnectionTimeout(timeout)
+
+	start := time.Now()
+	err := conn.Connect("127.0.0.1", "token")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, 期望 %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("连接超时未生效，耗时 %v", elapsed)
+	}
+}
+
+// videoSection 返回SDP中的视频段
+func videoSection(t *testing.T, sdp string) []string {
+	t.Helper()
+	var section []string
+	for _, line := range strings.Split(strings.TrimRight(sdp, "\r\n"), "\r\n") {
+		if strings.HasPrefix(line, "m=") {
+			if section != nil {
+				break
+			}
+			if strings.HasPrefix(line, "m=video ") {
+				section = []string{line}
+			}
+			continue
+		}
+		if section != nil {
+			section = append(section, line)
+		}
+	}
+	if section == nil {
+		t.Fatal("SDP中没有视频段")
+	}
+	return section
+}
+
+// sectionCodecs 返回视频段中payload type到编码名以及RTX到原编码的映射
+func sectionCodecs(section []string) (codecs map[string]string, rtxOf map[string]string) {
+	codecs = make(map[string]string)
+	rtxOf = make(map[string]string)
+	for _, line := range section {
+		if rest, ok := strings.CutPrefix(line, "a=rtpmap:"); ok {
+			pt, encoding, _ := strings.Cut(rest, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			codecs[pt] = strings.ToUpper(name)
+		} else if rest, ok := strings.CutPrefix(line, "a=fmtp:"); ok {
+			pt, params, _ := strings.Cut(rest, " ")
+			if apt, ok := strings.CutPrefix(params, "apt="); ok {
+				rtxOf[pt] = apt
+			}
+		}
+	}
+	return codecs, rtxOf
+}
+
+func TestMungeSDP(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	offer, err := conn.peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := videoSection(t, offer.SDP)
+	originalCodecs, _ := sectionCodecs(original)
+	var h264 []string
+	for _, pt := range strings.Fields(original[0])[3:] {
+		if originalCodecs[pt] == "H264" {
+			h264 = append(h264, pt)
+		}
+	}
+	if len(h264) == 0 {
+		t.Fatal("pion默认提议中没有H264")
+	}
+
+	t.Run("零值不改写", func(t *testing.T) {
+		if got := mungeSDP(offer.SDP, SDPMungeOptions{}); got != offer.SDP {
+			t.Error("零值选项不应改写SDP")
+		}
+	})
+
+	t.Run("码率和编码顺序", func(t *testing.T) {
+		munged := mungeSDP(offer.SDP, SDPMungeOptions{VideoBitrateKbps: 800, PreferredCodecs: []string{"h264"}})
+		section := videoSection(t, munged)
+
+		// b=AS紧跟在c=之后
+		connectionLine := -1
+		for i, line := range section {
+			if strings.HasPrefix(line, "c=") {
+				connectionLine = i
+				break
+			}
+		}
+		if connectionLine < 0 || connectionLine+1 >= len(section) || section[connectionLine+1] != "b=AS:800" {
+			t.Errorf("c=之后应为b=AS:800: %v", section)
+		}
+		if strings.Count(munged, "b=AS:") != 1 {
+			t.Errorf("应只有一行b=AS")
+		}
+
+		payloadTypes := strings.Fields(section[0])[3:]
+		if strings.Join(payloadTypes[:len(h264)], " ") != strings.Join(h264, " ") {
+			t.Errorf("H264应排在最前: %v", payloadTypes)
+		}
+		if len(payloadTypes) != len(strings.Fields(original[0])[3:]) {
+			t.Errorf("未设置RemoveOtherCodecs时不应移除编码")
+		}
+
+		if again := mungeSDP(munged, SDPMungeOptions{VideoBitrateKbps: 800, PreferredCodecs: []string{"h264"}}); again != munged {
+			t.Error("重复改写结果应不变")
+		}
+	})
+
+	t.Run("移除其他编码保留RTX", func(t *testing.T) {
+		opts := SDPMungeOptions{PreferredCodecs: []string{"H264"}, RemoveOtherCodecs: true}
+		munged := mungeSDP(offer.SDP, opts)
+		section := videoSection(t, munged)
+		codecs, rtxOf := sectionCodecs(section)
+
+		kept := make(map[string]bool)
+		rtxCount := 0
+		for _, pt := range strings.Fields(section[0])[3:] {
+			kept[pt] = true
+			switch codecs[pt] {
+			case "H264":
+			case "RTX":
+				if codecs[rtxOf[pt]] != "H264" {
+					t.Errorf("保留了非H264的RTX %s", pt)
+				}
+				rtxCount++
+			default:
+				t.Errorf("应移除编码 %s(%s)", pt, codecs[pt])
+			}
+		}
+		if rtxCount == 0 {
+			t.Error("应保留H264的RTX")
+		}
+		for _, line := range section[1:] {
+			if pt := sdpAttributePayloadType(line); pt != "" && !kept[pt] {
+				t.Errorf("已移除编码的属性行仍然存在: %s", line)
+			}
+		}
+
+		if again := mungeSDP(munged, opts); again != munged {
+			t.Error("重复改写结果应不变")
+		}
+
+		// 改写后的SDP仍可被对端解析
+		peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		if err := peer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: munged}); err != nil {
+			t.Fatalf("对端无法解析改写后的SDP: %v", err)
+		}
+	})
+}
+
+// messageAPIID 读取运动命令消息的api_id
+func messageAPIID(message Message) int {
+	data, _ := message.Data.(map[string]interface{})
+	header, _ := data["header"].(map[string]interface{})
+	identity, _ := header["identity"].(map[string]interface{})
+	id, _ := identity["api_id"].(float64)
+	return int(id)
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	const interval = 50 * time.Millisecond
+	conn.SetHeartbeatInterval(interval)
+	// 数据通道打开时和验证成功时都会启动心跳，只应有一个定时器
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+	robot.next(t, isType(HeartbeatType))
+
+	const beats = 8
+	start := time.Now()
+	last := start
+	for i := 0; i < beats; i++ {
+		robot.next(t, isType(HeartbeatType))
+		now := time.Now()
+		if gap := now.Sub(last); gap < interval/2 {
+			t.Fatalf("第%d次心跳间隔%v，小于设置的%v", i+1, gap, interval)
+		}
+		last = now
+	}
+	if average := time.Since(start) / beats; average < interval*8/10 || average > interval*2 {
+		t.Errorf("平均心跳间隔%v，期望约%v", average, interval)
+	}
+}
+
+func TestEmergencyCommandCancelsPendingJoystickMove(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+
+	moveID, dampID := SportCmd["Move"], SportCmd["Damp"]
+	if err := conn.Joystick(0.5, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	robot.next(t, func(message Message) bool { return messageAPIID(message) == moveID })
+
+	// 模拟摇杆循环已读取速度、正在等待发送缓冲的Move
+	conn.joystickMu.Lock()
+	stalled := conn.joystickStop
+	conn.joystickMu.Unlock()
+
+	if err := conn.SendCommand("Damp", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.sendJoystickMove(stalled, MoveParams{X: 0.5}); !errors.Is(err, errJoystickStopped) {
+		t.Fatalf("紧急命令之后的Move应被取消，err = %v", err)
+	}
+
+	// 等待超过数个摇杆发送周期，确认Damp之后没有Move到达机器人
+	robot.next(t, func(message Message) bool { return messageAPIID(message) == dampID })
+	deadline := time.After(5 * joystickSendInterval)
+	for {
+		select {
+		case message := <-robot.received:
+			if messageAPIID(message) == moveID {
+				t.Fatal("紧急命令之后机器人仍收到了Move")
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// sportResponse 构造机器人对请求id的响应
+func TestJoystickDeadmanSendsStopMove(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+
+	const deadman = 150 * time.Millisecond
+	conn.SetJoystickDeadman(deadman)
+	moveID, stopMoveID := SportCmd["Move"], SportCmd["StopMove"]
+
+	lastUpdate := time.Now()
+	if err := conn.Joystick(0.3, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不再更新速度，摇杆循环应先重复Move，超过死人开关时间后发送StopMove
+	moves := 0
+	for {
+		message := robot.next(t, func(message Message) bool {
+			id := messageAPIID(message)
+			return id == moveID || id == stopMoveID
+		})
+		if messageAPIID(message) == stopMoveID {
+			break
+		}
+		moves++
+	}
+	if elapsed := time.Since(lastUpdate); elapsed < deadman {
+		t.Fatalf("StopMove在最后一次更新后%v发送，早于死人开关时间%v", elapsed, deadman)
+	}
+	if moves < 2 {
+		t.Fatalf("StopMove之前只收到%d次Move，摇杆循环未重复发送", moves)
+	}
+
+	deadline := time.After(3 * joystickSendInterval)
+	for {
+		select {
+		case message := <-robot.received:
+			if messageAPIID(message) == moveID {
+				t.Fatal("StopMove之后机器人仍收到了Move")
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func sportResponse(requestID, apiID int, code int) Message {
+	return Message{Type: MessageType, Topic: "rt/api/sport/response", Data: map[string]interface{}{
+		"header": map[string]interface{}{
+			"identity": map[string]interface{}{"id": requestID, "api_id": apiID},
+			"status":   map[string]interface{}{"code": code},
+		},
+		"data": "",
+	}}
+}
+
+func TestSendCommandAckRetries(t *testing.T) {
+	standUpID := SportCmd["StandUp"]
+	var mu sync.Mutex
+	var attemptIDs []int
+	ackOn := 2
+
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, func(robot *testRobot, message Message) {
+		if messageAPIID(message) != standUpID {
+			return
+		}
+		requestID, _ := messageRequestID(message)
+		mu.Lock()
+		attemptIDs = append(attemptIDs, requestID)
+		acknowledge := len(attemptIDs) == ackOn // 只确认第ackOn次发送
+		mu.Unlock()
+		if acknowledge {
+			robot.write(sportResponse(requestID, standUpID, 0))
+		}
+	})
+	robot.validate(t, conn)
+	conn.SetCommandAckRetries(2)
+
+	if err := conn.SendCommandAck("StandUp", nil, 200*time.Millisecond); err != nil {
+		t.Fatalf("第二次发送被确认后应成功: %v", err)
+	}
+	mu.Lock()
+	if len(attemptIDs) != 2 || attemptIDs[0] != attemptIDs[1] {
+		t.Errorf("应以相同的请求id发送两次，实际 %v", attemptIDs)
+	}
+	attemptIDs = nil
+	ackOn = 0
+	mu.Unlock()
+
+	// 始终不确认时重发次数耗尽
+	err := conn.SendCommandAck("StandUp", nil, 50*time.Millisecond)
+	if !errors.Is(err, ErrCommandNotAcked) {
+		t.Fatalf("err = %v, 期望 %v", err, ErrCommandNotAcked)
+	}
+	mu.Lock()
+	if len(attemptIDs) != 3 {
+		t.Errorf("重发2次应共发送3次，实际 %d", len(attemptIDs))
+	}
+	mu.Unlock()
+}
+
+func TestQuery(t *testing.T) {
+	bodyHeightID, stateID := SportCmd["GetBodyHeight"], SportCmd["GetState"]
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, func(robot *testRobot, message Message) {
+		requestID, _ := messageRequestID(message)
+		switch messageAPIID(message) {
+		case bodyHeightID:
+			// 先发一条其他请求id的响应，不应被当作本次查询的结果
+			robot.write(sportResponse(requestID+1000, bodyHeightID, 0))
+			response := sportResponse(requestID, bodyHeightID, 0)
+			response.Data.(map[string]interface{})["data"] = `{"height":0.32}`
+			robot.write(response)
+		case stateID:
+			robot.write(sportResponse(requestID, stateID, 3104))
+		}
+	})
+	robot.validate(t, conn)
+
+	payload, err := conn.Query("GetBodyHeight", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height := payload.(map[string]interface{})["height"]; height != 0.32 {
+		t.Fatalf("解码后的data = %v", payload)
+	}
+
+	if _, err := conn.Query("GetState", 2*time.Second); err == nil || !strings.Contains(err.Error(), "3104") {
+		t.Fatalf("非0状态码应返回错误，err = %v", err)
+	}
+
+	// 机器人不响应时超时
+	start := time.Now()
+	if _, err := conn.Query("GetSpeedLevel", 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "超时") {
+		t.Fatalf("未响应时应超时，err = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("超时后%v才返回", elapsed)
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+
+	// 同一毫秒内的普通命令和等待响应的请求不能共用id
+	const count = 50
+	var wg sync.WaitGroup
+	pending := make(chan int, count)
+	for i := 0; i < count; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			conn.SendCommand("Hello", nil)
+		}()
+		go func() {
+			defer wg.Done()
+			pending <- conn.addPendingRequest(make(chan Message, 1))
+		}()
+	}
+	wg.Wait()
+	close(pending)
+
+	seen := make(map[int]bool)
+	for requestID := range pending {
+		seen[requestID] = true
+	}
+	helloID := SportCmd["Hello"]
+	for i := 0; i < count; i++ {
+		message := robot.next(t, func(message Message) bool { return messageAPIID(message) == helloID })
+		requestID, _ := messageRequestID(message)
+		if seen[requestID] {
+			t.Fatalf("请求id %d 重复", requestID)
+		}
+		seen[requestID] = true
+	}
+}
+
+// TestSettersDuringTraffic 在收发消息的同时修改回调和设置，需用go test -race运行才能发现数据竞争
+func TestSettersDuringTraffic(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	conn.SetHeartbeatInterval(10 * time.Millisecond)
+	robot := connectTestRobot(t, conn, nil)
+
+	telemetry := make(chan struct{})
+	var telemetryOnce sync.Once
+	onTelemetry := func(topic string, payload interface{}) {
+		telemetryOnce.Do(func() { close(telemetry) })
+	}
+	conn.OnTelemetry(onTelemetry)
+
+	joystickStarted := make(chan struct{})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			conn.SetJoystickDeadman(time.Duration(i%5+1) * time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			robot.write(Message{Type: MessageType, Topic: SportModeStateTopic, Data: map[string]interface{}{"mode": i}})
+			robot.write(Message{Type: "err", Data: map[string]interface{}{"info": "Validation Needed."}})
+			if i == 10 {
+				robot.write(Message{Type: ValidationType, Data: "Validation Ok."})
+				conn.Joystick(0.1, 0, 0)
+				close(joystickStarted)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		quiet := NewStdLogger(LogLevelError)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			conn.OnTelemetry(onTelemetry)
+			conn.OnRobotError(func(message Message) {})
+			conn.OnConnectionStateChange(func(state string) {})
+			conn.OnValidationFailed(func(err error) {})
+			conn.SetLogger(quiet)
+			conn.SetMaxMessageSize(defaultMaxMessageSize + i)
+			conn.SetMaxBufferedAmount(defaultMaxBufferedAmount + uint64(i))
+			conn.SetCommandAckRetries(i % 3)
+			conn.SetConnectionTimeout(time.Duration(i+1) * time.Second)
+			conn.SetRobotSignalingPort(9991)
+			conn.SetRobotHTTPTimeout(time.Second)
+			conn.SetSDPMunge(SDPMungeOptions{})
+			conn.SetHandshakeCipher(HandshakeCipherECB)
+			conn.SetCallbackPool(2, 64)
+			conn.SendCommand("BalanceStand", nil)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// 至少运行到有遥测回调执行且验证成功后的心跳开始发送
+	select {
+	case <-telemetry:
+	case <-time.After(5 * time.Second):
+		t.Fatal("未执行遥测回调")
+	}
+	robot.next(t, isType(HeartbeatType))
+
+	// 等待摇杆循环因死人开关停止
+	<-joystickStarted
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn.joystickMu.Lock()
+		running := conn.joystickStop != nil
+		conn.joystickMu.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("摇杆循环未因死人开关停止")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestVideoTrackAndKeyframeRequest(t *testing.T) {
+	packets := make(chan rtp.Packet, 64)
+	conn, err := NewGo2ConnectionWithOptions(ConnectionOptions{DisableMDNS: true}, nil, nil, nil, func(packet rtp.Packet) {
+		select {
+		case packets <- packet:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetLogger(NewStdLogger(LogLevelError))
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.RequestKeyframe(); err == nil {
+		t.Fatal("未收到视频轨道时RequestKeyframe应返回错误")
+	}
+
+	video, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, "video", "robot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	robot := connectTestRobotWithVideo(t, conn, nil, video)
+
+	// 机器人端收到的RTCP中的PLI
+	plis := make(chan uint32, 16)
+	go func() {
+		for {
+			received, _, err := robot.videoSender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range received {
+				if pli, ok := packet.(*rtcp.PictureLossIndication); ok {
+					plis <- pli.MediaSSRC
+				}
+			}
+		}
+	}()
+
+	// DTLS/SRTP建立前发出的包会丢失，持续发送直到onVideo收到
+	payload := []byte{0x65, 0x88, 0x84, 0x00}
+	var received rtp.Packet
+	timeout := time.After(10 * time.Second)
+	for sequence := uint16(1); ; sequence++ {
+		if err := video.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sequence, Timestamp: uint32(sequence) * 3000}, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case received = <-packets:
+		case <-time.After(20 * time.Millisecond):
+			continue
+		case <-timeout:
+			t.Fatal("onVideo未收到RTP包")
+		}
+		break
+	}
+	if string(received.Payload) != string(payload) {
+		t.Errorf("RTP负载 = %x, 期望 %x", received.Payload, payload)
+	}
+
+	ssrc := uint32(robot.videoSender.GetParameters().Encodings[0].SSRC)
+	if err := conn.RequestKeyframe(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case mediaSSRC := <-plis:
+		if mediaSSRC != ssrc {
+			t.Errorf("PLI的MediaSSRC = %d, 期望 %d", mediaSSRC, ssrc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("机器人未收到PLI")
+	}
+}
+
+// fillSendBuffer 直接向数据通道写入大量消息，使发送缓冲超过上限
+func fillSendBuffer(t *testing.T, conn *Go2Connection, bytes int) {
+	t.Helper()
+	filler, err := json.Marshal(Message{Type: MessageType, Topic: "filler", Data: strings.Repeat("x", 60*1024)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sent := 0; sent < bytes; sent += len(filler) {
+		if err := conn.dataChannel.SendText(string(filler)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+
+	// 上限低于默认低水位，缓冲回落到上限时也必须唤醒等待者
+	const limit = 32 * 1024
+	conn.SetMaxBufferedAmount(limit)
+	fillSendBuffer(t, conn, bufferedAmountLowThreshold+64*1024)
+	if conn.dataChannel.BufferedAmount() <= limit {
+		t.Fatal("发送缓冲未超过上限")
+	}
+
+	if err := conn.publish("", nil, HeartbeatType); err == nil {
+		t.Fatal("缓冲已满时心跳应被丢弃")
+	}
+
+	// 多个消息同时等待缓冲回落，都应被唤醒并发送
+	const waiters = 3
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			errs <- conn.publish("waiter"+strconv.Itoa(i), nil, MessageType)
+		}(i)
+	}
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("缓冲回落后消息未发送: %v", err)
+		}
+	}
+
+	topics := map[string]bool{}
+	for len(topics) < waiters {
+		message := robot.next(t, func(message Message) bool { return strings.HasPrefix(message.Topic, "waiter") })
+		topics[message.Topic] = true
+	}
+}
+
+func TestOversizedMessageDropped(t *testing.T) {
+	if defaultMaxMessageSize > math.MaxUint16 {
+		t.Fatalf("默认上限%d超过pion的读缓冲", defaultMaxMessageSize)
+	}
+
+	conn := newTestConnection(t, ConnectionOptions{})
+	const limit = 1024
+	conn.SetMaxMessageSize(limit)
+	robotErrors := make(chan Message, 2)
+	conn.OnRobotError(func(message Message) { robotErrors <- message })
+
+	deliver := func(info string) {
+		payload, err := json.Marshal(Message{Type: "err", Data: map[string]interface{}{"info": info}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.handleDataChannelMessage(webrtc.DataChannelMessage{IsString: true, Data: payload})
+	}
+
+	deliver(strings.Repeat("x", limit))
+	deliver("small")
+	select {
+	case message := <-robotErrors:
+		if info := message.Data.(map[string]interface{})["info"]; info != "small" {
+			t.Fatalf("超过上限的消息不应被处理，收到info长度%d", len(info.(string)))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("未在上限内的消息未被处理")
+	}
+
+	dropped := false
+	for _, event := range conn.Events() {
+		if event.Type == "datachannel" && strings.HasPrefix(event.Detail, "oversized message dropped") {
+			dropped = true
+		}
+	}
+	if !dropped {
+		t.Fatal("未记录丢弃超大消息的事件")
+	}
+}
+
+func TestSlowCallbackDoesNotBlockReading(t *testing.T) {
+	validated := make(chan struct{})
+	release := make(chan struct{})
+	conn, err := NewGo2ConnectionWithOptions(ConnectionOptions{DisableMDNS: true}, func() {
+		close(validated)
+		<-release // 阻塞唯一的回调工作协程
+	}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetLogger(NewStdLogger(LogLevelError))
+	t.Cleanup(func() { conn.Close() })
+	var releaseOnce sync.Once
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+	const queueSize = 4
+	conn.SetCallbackPool(1, queueSize)
+	robotErrors := make(chan string, 16)
+	conn.OnRobotError(func(message Message) {
+		robotErrors <- message.Data.(map[string]interface{})["info"].(string)
+	})
+
+	standUpID := SportCmd["StandUp"]
+	robot := connectTestRobot(t, conn, func(robot *testRobot, message Message) {
+		if messageAPIID(message) == standUpID {
+			requestID, _ := messageRequestID(message)
+			robot.write(sportResponse(requestID, standUpID, 0))
+		}
+	})
+	robot.validate(t, conn)
+	select {
+	case <-validated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("未调用onValidated")
+	}
+
+	// 回调阻塞期间的错误消息超过队列长度，最旧的被丢弃
+	const sent = 10
+	for i := 0; i < sent; i++ {
+		robot.send(t, Message{Type: "err", Data: map[string]interface{}{"info": strconv.Itoa(i)}})
+	}
+
+	// 数据通道读取未被阻塞，后续的响应仍能送达
+	if err := conn.SendCommandAck("StandUp", nil, 2*time.Second); err != nil {
+		t.Fatalf("回调阻塞时命令确认失败: %v", err)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	var infos []string
+	timeout := time.After(5 * time.Second)
+	for len(infos) == 0 || infos[len(infos)-1] != strconv.Itoa(sent-1) {
+		select {
+		case info := <-robotErrors:
+			infos = append(infos, info)
+		case <-timeout:
+			t.Fatalf("未收到最后一条错误消息，已收到 %v", infos)
+		}
+	}
+	if len(infos) >= sent || infos[0] == "0" {
+		t.Fatalf("队列满时应丢弃最旧的回调，收到 %v", infos)
+	}
+}
+
+func TestRSALoadPublicKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "机器人的Base64 DER", input: base64.StdEncoding.EncodeToString(pkix)},
+		{name: "PEM PUBLIC KEY", input: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))},
+		{name: "PEM RSA PUBLIC KEY", input: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pkcs1}))},
+		{name: "PEM前后有空白", input: "\n  " + string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})) + "\n"},
+		{name: "乱码", input: "garbage!!", wantErr: "既不是PEM也不是有效的Base64"},
+		{name: "Base64但不是公钥", input: base64.StdEncoding.EncodeToString([]byte("not a key")), wantErr: "解析公钥失败"},
+		{name: "PEM内容损坏", input: "-----BEGIN PUBLIC KEY-----\nnot base64\n-----END PUBLIC KEY-----\n", wantErr: "无效的PEM公钥"},
+		{name: "PEM类型不支持", input: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pkix})), wantErr: "不支持的PEM类型"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := rsaLoadPublicKey(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, 期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Equal(&privateKey.PublicKey) {
+				t.Error("加载的公钥与原公钥不一致")
+			}
+		})
+	}
+}
+
+func TestMoveBoundaries(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+
+	above := func(v float64) float64 { return math.Nextafter(v, math.Inf(1)) }
+	below := func(v float64) float64 { return math.Nextafter(v, math.Inf(-1)) }
+	tests := []struct {
+		name      string
+		x, y, z   float64
+		parameter string // 为空表示应被拒绝
+	}{
+		{name: "x下限", x: moveMinX, parameter: `{"x":-2.5,"y":0,"z":0}`},
+		{name: "x上限", x: moveMaxX, parameter: `{"x":3.8,"y":0,"z":0}`},
+		{name: "y下限", y: moveMinY, parameter: `{"x":0,"y":-1,"z":0}`},
+		{name: "y上限", y: moveMaxY, parameter: `{"x":0,"y":1,"z":0}`},
+		{name: "z下限", z: moveMinZ, parameter: `{"x":0,"y":0,"z":-4}`},
+		{name: "z上限", z: moveMaxZ, parameter: `{"x":0,"y":0,"z":4}`},
+		{name: "低于x下限", x: below(moveMinX)},
+		{name: "高于x上限", x: above(moveMaxX)},
+		{name: "低于y下限", y: below(moveMinY)},
+		{name: "高于y上限", y: above(moveMaxY)},
+		{name: "低于z下限", z: below(moveMinZ)},
+		{name: "高于z上限", z: above(moveMaxZ)},
+		{name: "x为NaN", x: math.NaN()},
+		{name: "y为NaN", y: math.NaN()},
+		{name: "z为NaN", z: math.NaN()},
+		{name: "x为+Inf", x: math.Inf(1)},
+		{name: "y为-Inf", y: math.Inf(-1)},
+		{name: "z为+Inf", z: math.Inf(1)},
+	}
+
+	moveID := SportCmd["Move"]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := conn.Move(tt.x, tt.y, tt.z)
+			if tt.parameter == "" {
+				if err == nil {
+					t.Fatal("超出范围的速度应被拒绝")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			message := robot.next(t, func(message Message) bool { return messageAPIID(message) == moveID })
+			if message.Type != MessageType || message.Topic != "rt/api/sport/request" {
+				t.Errorf("type/topic = %s/%s", message.Type, message.Topic)
+			}
+			if parameter := message.Data.(map[string]interface{})["parameter"]; parameter != tt.parameter {
+				t.Errorf("parameter = %v, 期望 %s", parameter, tt.parameter)
+			}
+		})
+	}
+
+	// 被拒绝的速度不应发送给机器人
+	moves := 0
+	for _, record := range conn.CommandHistory() {
+		if record.Command == "Move" && !record.Rejected {
+			moves++
+		}
+	}
+	if moves != 6 {
+		t.Errorf("应只发送6次Move，实际 %d", moves)
+	}
+}
+
+func TestSetCommandTopics(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+
+	if err := conn.SetCommandTopics(map[string]string{"NoSuchCommand": "rt/x"}); err == nil {
+		t.Error("未知命令应返回错误")
+	}
+	if err := conn.SetCommandTopics(map[string]string{"StandUp": ""}); err == nil {
+		t.Error("空话题应返回错误")
+	}
+
+	const customTopic = "rt/api/custom/request"
+	if err := conn.SetCommandTopics(map[string]string{"StandUp": customTopic}); err != nil {
+		t.Fatal(err)
+	}
+	standUpID, standDownID := SportCmd["StandUp"], SportCmd["StandDown"]
+	for _, command := range []string{"StandUp", "StandDown"} {
+		if err := conn.SendCommand(command, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if message := robot.next(t, func(message Message) bool { return messageAPIID(message) == standUpID }); message.Topic != customTopic {
+		t.Errorf("StandUp发布到 %s, 期望 %s", message.Topic, customTopic)
+	}
+	if message := robot.next(t, func(message Message) bool { return messageAPIID(message) == standDownID }); message.Topic != SportRequestTopic {
+		t.Errorf("未重映射的StandDown发布到 %s, 期望 %s", message.Topic, SportRequestTopic)
+	}
+}
+
+func TestCommandHistory(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	robot := connectTestRobot(t, conn, nil)
+	robot.validate(t, conn)
+
+	if err := conn.SendCommand("StandUp", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Move(10, 0, 0); err == nil {
+		t.Fatal("超出范围的Move应被拒绝")
+	}
+	if err := conn.Joystick(0, 5, 0); err == nil {
+		t.Fatal("超出范围的摇杆速度应被拒绝")
+	}
+	if err := conn.SendCommand("Unknown", nil); err == nil {
+		t.Fatal("未知命令应被拒绝")
+	}
+	if err := conn.SendCommand("Move", nil); err == nil {
+		t.Fatal("缺少参数的Move应被拒绝")
+	}
+	if err := conn.Move(0.3, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		command  string
+		rejected bool
+	}{
+		{"StandUp", false},
+		{"Move", true},
+		{"Move", true},
+		{"Unknown", true},
+		{"Move", true},
+		{"Move", false},
+	}
+	history := conn.CommandHistory()
+	if len(history) != len(want) {
+		t.Fatalf("历史记录 %d 条, 期望 %d 条: %+v", len(history), len(want), history)
+	}
+	for i, record := range history {
+		if record.Command != want[i].command || record.Rejected != want[i].rejected {
+			t.Errorf("第%d条 = %s(rejected=%v), 期望 %s(rejected=%v)", i, record.Command, record.Rejected, want[i].command, want[i].rejected)
+		}
+		if record.Rejected != (record.Error != "") {
+			t.Errorf("第%d条被拒绝时应记录原因: %+v", i, record)
+		}
+		if !record.Rejected && record.RequestID == 0 {
+			t.Errorf("第%d条已发送的命令应记录请求id", i)
+		}
+	}
+}
+
+func TestCommandHistoryIsBounded(t *testing.T) {
+	conn := newTestConnection(t, ConnectionOptions{})
+	for i := 0; i < maxCommandHistory+10; i++ {
+		conn.recordCommand("Hello", i, i, nil)
+	}
+
+	history := conn.CommandHistory()
+	if len(history) != maxCommandHistory {
+		t.Fatalf("历史记录 %d 条, 期望 %d 条", len(history), maxCommandHistory)
+	}
+	if history[0].RequestID != 10 || history[len(history)-1].RequestID != maxCommandHistory+9 {
+		t.Errorf("应按时间顺序保留最近的记录: 首条 %d, 末条 %d", history[0].RequestID, history[len(history)-1].RequestID)
+	}
+}
+
+func TestH264FmtpLine(t *testing.T) {
+	const fmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+	conn := newTestConnection(t, ConnectionOptions{H264FmtpLine: fmtp})
+	offer, err := conn.peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section := videoSection(t, offer.SDP)
+	codecs, rtxOf := sectionCodecs(section)
+	if !strings.Contains(offer.SDP, "a=fmtp:102 "+fmtp+"\r\n") {
+		t.Errorf("提议中缺少配置的fmtp:\n%s", offer.SDP)
+	}
+	for _, pt := range strings.Fields(section[0])[3:] {
+		if codecs[pt] != "H264" && !(codecs[pt] == "RTX" && rtxOf[pt] == "102") {
+			t.Errorf("只应注册H264及其RTX，发现 %s(%s)", pt, codecs[pt])
+		}
+	}
+}
+
+// settingEngineFields 读取SettingEngine中与ConnectionOptions对应的未导出字段
+func settingEngineFields(settingEngine webrtc.SettingEngine) (networkTypes []webrtc.NetworkType, mdnsMode ice.MulticastDNSMode, portMin, portMax uint16) {
+	value := reflect.ValueOf(settingEngine)
+	candidates := value.FieldByName("candidates")
+	types := candidates.FieldByName("ICENetworkTypes")
+	for i := 0; i < types.Len(); i++ {
+		networkTypes = append(networkTypes, webrtc.NetworkType(types.Index(i).Int()))
+	}
+	mdnsMode = ice.MulticastDNSMode(candidates.FieldByName("MulticastDNSMode").Uint())
+	ephemeralUDP := value.FieldByName("ephemeralUDP")
+	return networkTypes, mdnsMode, uint16(ephemeralUDP.FieldByName("PortMin").Uint()), uint16(ephemeralUDP.FieldByName("PortMax").Uint())
+}
+
+func TestNewSettingEngine(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         ConnectionOptions
+		networkTypes []webrtc.NetworkType
+		mdnsMode     ice.MulticastDNSMode
+		portMin      uint16
+		portMax      uint16
+	}{
+		{name: "默认", opts: ConnectionOptions{}},
+		{name: "禁用mDNS", opts: ConnectionOptions{DisableMDNS: true}, mdnsMode: ice.MulticastDNSModeDisabled},
+		{name: "禁用IPv6", opts: ConnectionOptions{DisableIPv6: true}, networkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4}},
+		{name: "端口范围", opts: ConnectionOptions{UDPPortMin: 50000, UDPPortMax: 50100}, portMin: 50000, portMax: 50100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settingEngine, err := newSettingEngine(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			networkTypes, mdnsMode, portMin, portMax := settingEngineFields(settingEngine)
+			if !reflect.DeepEqual(networkTypes, tt.networkTypes) {
+				t.Errorf("网络类型 = %v, 期望 %v", networkTypes, tt.networkTypes)
+			}
+			if mdnsMode != tt.mdnsMode {
+				t.Errorf("mDNS模式 = %v, 期望 %v", mdnsMode, tt.mdnsMode)
+			}
+			if portMin != tt.portMin || portMax != tt.portMax {
+				t.Errorf("端口范围 = %d-%d, 期望 %d-%d", portMin, portMax, tt.portMin, tt.portMax)
+			}
+		})
+	}
+}
+
+func TestConnectionOptionsValidate(t *testing.T) {
+	one := uint16(1)
+	tests := []struct {
+		name    string
+		opts    ConnectionOptions
+		wantErr bool
+	}{
+		{name: "零值", opts: ConnectionOptions{}},
+		{name: "有效端口范围", opts: ConnectionOptions{UDPPortMin: 50000, UDPPortMax: 50100}},
+		{name: "端口范围反向", opts: ConnectionOptions{UDPPortMin: 50100, UDPPortMax: 50000}, wantErr: true},
+		{name: "只设置最大端口", opts: ConnectionOptions{UDPPortMax: 50000}, wantErr: true},
+		{name: "重传限制互斥", opts: ConnectionOptions{DataChannelMaxRetransmits: &one, DataChannelMaxPacketLifeTime: &one}, wantErr: true},
+		{name: "有效fmtp", opts: ConnectionOptions{H264FmtpLine: "packetization-mode=1;profile-level-id=42e01f"}},
+		{name: "fmtp不是key=value", opts: ConnectionOptions{H264FmtpLine: "packetization-mode"}, wantErr: true},
+		{name: "fmtp参数名非法", opts: ConnectionOptions{H264FmtpLine: "packetization mode=1"}, wantErr: true},
+		{name: "profile-level-id长度错误", opts: ConnectionOptions{H264FmtpLine: "profile-level-id=42e0"}, wantErr: true},
+		{name: "profile-level-id不是十六进制", opts: ConnectionOptions{H264FmtpLine: "profile-level-id=42zz1f"}, wantErr: true},
+		{name: "packetization-mode越界", opts: ConnectionOptions{H264FmtpLine: "packetization-mode=3"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr = %v", err, tt.wantErr)
+			}
+			// 构造连接时同样校验
+			if _, err := newWebRTCAPI(tt.opts); (err != nil) != tt.wantErr {
+				t.Fatalf("newWebRTCAPI err = %v, wantErr = %v", err, tt.wantErr)
+			}
+		})
+	}
+}